@@ -12,8 +12,21 @@ import(
 	"encoding/binary"
 	"reflect"
 	"math"
+	"math/big"
+	"sort"
+	"context"
+	"time"
+	"unicode/utf8"
+	"hash/fnv"
+	"unicode"
+	"encoding/hex"
+	"regexp"
+	"unsafe"
 )
 
+// Version of this VM, as reported by the version instruction
+const Version = "0.2.0"
+
 // Iceberg Types
 const(
 	T_UNDET int64 = 0
@@ -22,23 +35,162 @@ const(
 	T_BOOL  int64 = 4
 	T_STR   int64 = 8
 	T_LABEL int64 = 16
+	T_NIL   int64 = 32
 
-	T_ANY   int64 = 31
+	T_ANY   int64 = 63
 )
 
+var type_names = []struct {
+	e_type int64
+	name string
+}{
+	{ T_INT, "int" },
+	{ T_FLOAT, "float" },
+	{ T_BOOL, "bool" },
+	{ T_STR, "str" },
+	{ T_LABEL, "label" },
+	{ T_NIL, "nil" },
+}
+
+// Name of a type id, or of each type in a mask joined with '|' (e.g. "int|float")
+func TypeName(t int64) string {
+	switch t {
+	case T_UNDET:
+		return "undet"
+	case T_ANY:
+		return "any"
+	}
+	names := make([]string, 0, 1)
+	for _, type_name := range type_names {
+		if t & type_name.e_type != 0 {
+			names = append(names, type_name.name)
+			t ^= type_name.e_type
+		}
+	}
+	if t != 0 {
+		names = append(names, fmt.Sprintf("unknown(%d)", t))
+	}
+	return strings.Join(names, "|")
+}
+
 type Entity struct {
 	Data []byte
 	E_type int64
 }
 
+// Shows the decoded value and its type, e.g. 42:int or "hi":str; a symbol shows its name
+func (e Entity) String() string {
+	if e.E_type == T_UNDET {
+		return string(e.Data)
+	}
+	if e.E_type == T_NIL {
+		return "nil"
+	}
+	value, err := decode_entity(e)
+	if err != nil {
+		return fmt.Sprintf("<invalid>:%d", e.E_type)
+	}
+	if e.E_type == T_STR {
+		value = strconv.Quote(value.(string))
+	}
+	return fmt.Sprintf("%v:%s", value, TypeName(e.E_type))
+}
+
 type instruction struct {
 	Inst string
 	Args []Entity
 }
 
+// An instruction takes exactly N_args arguments when Max_args is 0, otherwise
+// N_args to Max_args of them; Max_args of N_UNLIMITED puts no upper bound
 type InstructionDesc struct {
 	Function func([]Entity)
 	N_args int64
+	Max_args int64
+	// One-line description for Help; optional
+	Doc string
+}
+
+const N_UNLIMITED int64 = -1
+
+type try_handler struct {
+	label string
+	err_symbol string
+	n_scopes int
+}
+
+// Error categories, taken from the "<Kind> ERROR:" prefix of a message
+type ErrorKind int64
+
+const(
+	ERR_SYSTEM   ErrorKind = 0
+	ERR_SYNTAX   ErrorKind = 1
+	ERR_TYPE     ErrorKind = 2
+	ERR_MATH     ErrorKind = 3
+	ERR_ARGUMENT ErrorKind = 4
+	ERR_VM       ErrorKind = 5
+)
+
+var error_kinds = map[string]ErrorKind{
+	"System": ERR_SYSTEM,
+	"Syntax": ERR_SYNTAX,
+	"Type": ERR_TYPE,
+	"Math": ERR_MATH,
+	"Argument": ERR_ARGUMENT,
+	"VM": ERR_VM,
+}
+
+// Pos is the source line for compile errors and the instruction number for runtime errors.
+// Host_call errors come from API calls such as SetVar and have no position.
+type IcebergError struct {
+	Kind ErrorKind
+	Pos int64
+	Compile_time bool
+	Message string
+	Host_call bool
+}
+
+func (err *IcebergError) Error() string {
+	if err.Host_call {
+		return err.Message
+	}
+	if err.Compile_time {
+		return fmt.Sprintf("In line %d,\n%s", err.Pos, err.Message)
+	}
+	return fmt.Sprintf("Iceberg runtime ERROR!\nIn instruction number %d,\n%s", err.Pos, err.Message)
+}
+
+func new_error(message string, pos int64, compile_time bool) *IcebergError {
+	kind := ERR_SYSTEM
+	sep_message := strings.SplitN(message, " ERROR:", 2)
+	if len(sep_message) == 2 {
+		prefix_kind, ok := error_kinds[sep_message[0]]
+		if ok {
+			kind = prefix_kind
+		}
+	}
+	return &IcebergError{
+		kind,
+		pos,
+		compile_time,
+		message,
+		false,
+	}
+}
+
+// Filesystem used by readfile and writefile, so hosts can sandbox or fake it
+type FileSystem interface {
+	Open(name string) (io.ReadCloser, error)
+	Create(name string) (io.WriteCloser, error)
+}
+
+type os_fs struct{}
+
+func (os_fs) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+func (os_fs) Create(name string) (io.WriteCloser, error) {
+	return os.Create(name)
 }
 
 type Bytecode struct {
@@ -46,31 +198,74 @@ type Bytecode struct {
 	label_table map[string]int64
 }
 
+// Init binds the built-in instructions to this particular VM, so a VM must not be
+// copied by value after Init: the copy would run them against the original's state.
+// Use Clone instead; Run and EvalLine panic on a copied VM.
 type IcebergVM struct {
+	self *IcebergVM
 	exec_pos int64
 	Inst_table map[string]InstructionDesc
+	// What this VM bound under each name, so Clone can bind the same instruction to the clone
+	bound_insts map[string]bound_inst
+	inst_list []instruction
+	jumped bool
 	label_table map[string]int64
 	var_table map[string]Entity
+	scope_stack []map[string]Entity
+	value_stack []Entity
+	try_stack []try_handler
+	literal_pool map[literal_key]Entity
+	eval_list []instruction
+	eval_labels map[string]int64
+	mem_used int64
+	regex_cache map[string]*regexp.Regexp
+	exit_code int64
+
+	StrictFloat bool
+	// Starts a comment running to the end of the line; "#" after Init, "" disables
+	CommentPrefix string
+	// Matches instruction names regardless of case; labels and arguments are unaffected
+	CaseInsensitive bool
+	// Makes getenv, readfile and writefile raise an error, for untrusted code
+	SafeMode bool
+	// Longest string a script may build, in bytes; 0 means unlimited
+	MaxStringLen int
+	// Cap on the summed data size of all variables and stack values; 0 means unlimited
+	MaxMemoryBytes int64
+	// Used by getenv; os.LookupEnv when nil
+	Environ func(string) (string, bool)
+	// Used by readfile and writefile; the real filesystem when nil
+	FS FileSystem
+	// Used by print, dump and warnings; os.Stdout when nil
+	Stdout io.Writer
 }
 
 func (vm *IcebergVM) Read_str(str string) io.Reader {
 	return strings.NewReader(str)
 }
 
+// compile_error and Runtime_error panic with *IcebergError; Run recovers it and returns it
 func (vm *IcebergVM) compile_error(message string) {
-	fmt.Printf("In line %d,\n%s\n", vm.exec_pos + 1, message)
-	os.Exit(1)
+	panic(new_error(message, vm.exec_pos + 1, true))
 }
 func (vm *IcebergVM) Runtime_error(message string) {
-	fmt.Printf("\nIceberg runtime ERROR!\nIn instruction number %d,\n%s\n", vm.exec_pos, message)
-	os.Exit(1)
+	panic(new_error(message, vm.exec_pos, false))
 }
 func (vm *IcebergVM) Runtime_warning(message string) {
-	fmt.Printf("\nWARNING:\nIn instruction number %d,\n%s\n", vm.exec_pos, message)
+	fmt.Fprintf(vm.stdout(), "\nWARNING:\nIn instruction number %d,\n%s\n", vm.exec_pos, message)
 }
 
-func (vm *IcebergVM) chk_nargs(args []Entity, expected_nargs int64) {
+func (vm *IcebergVM) chk_nargs(args []Entity, desc InstructionDesc) {
+	expected_nargs := desc.N_args
 	n_elements := int64(len(args))
+	if desc.Max_args != 0 {
+		if n_elements < desc.N_args {
+			vm.compile_error(fmt.Sprintf("Syntax ERROR: Too few arguments(at least %d expected but %d given)", desc.N_args, n_elements))
+		} else if desc.Max_args != N_UNLIMITED && n_elements > desc.Max_args {
+			vm.compile_error(fmt.Sprintf("Syntax ERROR: Too many arguments(at most %d expected but %d given)", desc.Max_args, n_elements))
+		}
+		return
+	}
 	if n_elements > expected_nargs {
 		vm.compile_error(fmt.Sprintf("Syntax ERROR: Too many arguments(%d expected but %d given)", expected_nargs, n_elements))
 	} else if n_elements < expected_nargs {
@@ -108,6 +303,13 @@ func (vm *IcebergVM) conv_arg(bs_arg []byte) Entity {
 		}
 	}
 	
+	// Nil?
+	if arg_str == "nil" {
+		return Entity{
+			[]byte{},
+			T_NIL,
+		}
+	}
 	// Boolean?
 	if arg_str == "true" || arg_str == "false" {
 		temp_arg := arg_str == "true"
@@ -156,6 +358,43 @@ func (vm *IcebergVM) conv_arg(bs_arg []byte) Entity {
 	}
 }
 
+type literal_key struct {
+	e_type int64
+	data string
+}
+
+// A label is '@' followed by letters, digits and underscores, not starting with a digit
+func (vm *IcebergVM) chk_label(label string) {
+	name := strings.TrimPrefix(label, "@")
+	valid := name != ""
+	for i, c := range name {
+		if !(unicode.IsLetter(c) || c == '_' || (i > 0 && unicode.IsDigit(c))) {
+			valid = false
+		}
+	}
+	if !valid {
+		vm.compile_error(fmt.Sprintf("Syntax ERROR: Invalid label name %s", label))
+	}
+}
+
+// Like conv_arg, but identical literals within one compilation share a single Data buffer
+func (vm *IcebergVM) conv_literal(bs_arg []byte) Entity {
+	arg := vm.conv_arg(bs_arg)
+	if arg.E_type == T_LABEL {
+		vm.chk_label(string(arg.Data))
+	}
+	if vm.literal_pool == nil {
+		return arg
+	}
+	key := literal_key{arg.E_type, string(arg.Data)}
+	pooled, exist := vm.literal_pool[key]
+	if exist {
+		return pooled
+	}
+	vm.literal_pool[key] = arg
+	return arg
+}
+
 func (vm *IcebergVM) parse_args(line string) []Entity {
 	args := make([]Entity, 0)
 	buf := make([]byte, len(line))
@@ -164,35 +403,39 @@ func (vm *IcebergVM) parse_args(line string) []Entity {
 	s_quote := false
 	after_parentheses := false
 
-	for _, c := range line {
+	// Copies the whole rune at line[i] so multibyte characters stay intact
+	put_rune := func(i int) {
+		_, size := utf8.DecodeRuneInString(line[i:])
+		buf_idx += copy(buf[buf_idx:], line[i:i+size])
+	}
+
+	for i, c := range line {
 		if d_quote {
 			if c == '"' {
 				buf[buf_idx] = byte('"')
 				buf_idx++
-				args = append(args, vm.conv_arg(buf[:buf_idx]))
+				args = append(args, vm.conv_literal(buf[:buf_idx]))
 				buf_idx = 0
 				d_quote = false
 				after_parentheses = true
 			} else {
-				buf[buf_idx] = byte(c)
-				buf_idx++
+				put_rune(i)
 			}
 		} else if s_quote {
 			if c == '\'' {
 				buf[buf_idx] = byte('\'')
 				buf_idx++
-				args = append(args, vm.conv_arg(buf[:buf_idx]))
+				args = append(args, vm.conv_literal(buf[:buf_idx]))
 				buf_idx = 0
 				s_quote = false
 				after_parentheses = true
 			} else {
-				buf[buf_idx] = byte(c)
-				buf_idx++
+				put_rune(i)
 			}
 		} else {
 			if c == ',' {
 				if !after_parentheses {
-					args = append(args, vm.conv_arg(buf[:buf_idx]))
+					args = append(args, vm.conv_literal(buf[:buf_idx]))
 					buf_idx = 0
 				} else {
 					after_parentheses = false
@@ -211,16 +454,15 @@ func (vm *IcebergVM) parse_args(line string) []Entity {
 				buf[buf_idx] = byte('\'')
 				buf_idx++
 				s_quote = true
-			} else if c != ' ' {
+			} else if !is_blank(c) {
 				if !after_parentheses {
-					buf[buf_idx] = byte(c)
-					buf_idx++
+					put_rune(i)
 				}
 			}
 		}
 	}
 	if buf_idx != 0 {
-		args = append(args, vm.conv_arg(buf[:buf_idx]))
+		args = append(args, vm.conv_literal(buf[:buf_idx]))
 	}
 
 	if d_quote {
@@ -233,20 +475,33 @@ func (vm *IcebergVM) parse_args(line string) []Entity {
 	return args
 }
 
+// The Inst_table key for an instruction token. With CaseInsensitive, a token that
+// is not registered as written falls back to its lowercase form; labels are kept.
+func (vm *IcebergVM) lookup_name(token string) string {
+	if !vm.CaseInsensitive || strings.IndexRune(token, '@') == 0 {
+		return token
+	}
+	_, exist := vm.Inst_table[token]
+	if exist {
+		return token
+	}
+	return strings.ToLower(token)
+}
+
 func (vm *IcebergVM) parse_oneline(line string, program []instruction) []instruction {
-	new_program := make([]instruction, len(program))
-	copy(new_program, program)
-	if strings.IndexRune(line, ' ') == -1 {
-		instr := line
+	sep_idx := strings.IndexFunc(line, is_blank)
+	if sep_idx == -1 {
+		instr := vm.lookup_name(line)
 		_, ok := vm.Inst_table[instr]
 		if ok {
-			vm.chk_nargs([]Entity{}, vm.Inst_table[instr].N_args)
-			new_program = append(new_program, instruction{
+			vm.chk_nargs([]Entity{}, vm.Inst_table[instr])
+			program = append(program, instruction{
 				instr,
 				[]Entity{},
 			})
 		} else if strings.IndexRune(line, '@') == 0 {
-			new_program = append(new_program, instruction{
+			vm.chk_label(line)
+			program = append(program, instruction{
 				instr,
 				[]Entity{},
 			})
@@ -254,121 +509,244 @@ func (vm *IcebergVM) parse_oneline(line string, program []instruction) []instruc
 			vm.compile_error(fmt.Sprintf("Syntax ERROR: Unknown instruction %s", instr))
 		}
 	} else {
-		sep_line := strings.SplitN(line, " ", 2)
-		instr := sep_line[0]
+		instr := vm.lookup_name(line[:sep_idx])
 		_, ok := vm.Inst_table[instr]
 		if ok {
-			args := vm.parse_args(sep_line[1])
-			vm.chk_nargs(args, vm.Inst_table[instr].N_args)
-			new_program = append(new_program, instruction{
+			args := vm.parse_args(line[sep_idx+1:])
+			vm.chk_nargs(args, vm.Inst_table[instr])
+			program = append(program, instruction{
 				instr,
 				args,
 			})
 		} else if strings.IndexRune(instr, '@') == 0 {
-			vm.compile_error("Syntax ERROR: Expected newline after label definition")
+			// A label may prefix the instruction it points to
+			vm.chk_label(instr)
+			program = append(program, instruction{
+				instr,
+				[]Entity{},
+			})
+			program = vm.parse_oneline(strings.TrimLeftFunc(line[sep_idx+1:], is_blank), program)
 		} else {
 			vm.compile_error(fmt.Sprintf("Syntax ERROR: Unknown instruction %s", instr))
 		}
 	}
-	return new_program
+	return program
 }
 
+// Rewrites label lines to nop in place; program is the one freshly built by parse_script
 func (vm *IcebergVM) set_labels(program []instruction) ([]instruction, map[string]int64) {
-	new_program := make([]instruction, len(program))
-	copy(new_program, program)
 	label_table := make(map[string]int64)
-	for i, instr := range program {
-		if strings.IndexRune(instr.Inst, '@') == 0 {
-			label_table[instr.Inst] = int64(i)
-			new_program[i].Inst = "nop"
+	for i := range program {
+		if strings.IndexRune(program[i].Inst, '@') == 0 {
+			label_table[program[i].Inst] = int64(i)
+			program[i].Inst = "nop"
 		}
 	}
-	return new_program, label_table
+	return program, label_table
 }
 
 func (vm *IcebergVM) parse_script(script string) ([]instruction, map[string]int64) {
 	program := make([]instruction, 0)
+	vm.literal_pool = make(map[literal_key]Entity)
+	defer func() { vm.literal_pool = nil }()
 
-	lines := strings.Split(script, "\n")
-	for i, line := range lines {
+	lines := strings.Split(vm.strip_comments(script), "\n")
+	for i := 0; i < len(lines); i++ {
 		vm.exec_pos = int64(i)
-		line = strings.TrimLeftFunc(line, func(c rune) bool { return c == '\n' || c == '\t' || c == ' '})
-		program = vm.parse_oneline(line, program)
+		line := strings.TrimLeftFunc(lines[i], is_blank)
+		// A string literal left open continues on the next line
+		for open_quote(line) != 0 && i + 1 < len(lines) {
+			i++
+			line += "\n" + lines[i]
+		}
+		for _, statement := range split_statements(line) {
+			statement = strings.TrimFunc(statement, is_blank)
+			program = vm.parse_oneline(statement, program)
+		}
 	}
 	return vm.set_labels(program)
 }
 
-func (vm *IcebergVM) Gen_bytecode(script string) Bytecode {
+// Blanks out line comments starting with CommentPrefix and /* */ comments outside
+// of string literals, keeping their newlines so line numbers stay the same.
+// Block comments do not nest: the first */ ends the comment. Quotes inside a
+// comment are plain text, so /* a 5" screen */ is fine.
+func (vm *IcebergVM) strip_comments(script string) string {
+	prefix := []byte(vm.CommentPrefix)
+	if !strings.Contains(script, "/*") && (len(prefix) == 0 || !strings.Contains(script, vm.CommentPrefix)) {
+		return script
+	}
+	buf := []byte(script)
+	var quote byte
+	n_line := 0
+	for i := 0; i < len(buf); i++ {
+		c := buf[i]
+		if c == '\n' {
+			n_line++
+		}
+		if quote != 0 {
+			if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		if c == '"' || c == '\'' {
+			quote = c
+			continue
+		}
+		if len(prefix) != 0 && bytes.HasPrefix(buf[i:], prefix) {
+			for ; i < len(buf) && buf[i] != '\n'; i++ {
+				buf[i] = ' '
+			}
+			i--
+			continue
+		}
+		if c != '/' || i + 1 >= len(buf) || buf[i+1] != '*' {
+			continue
+		}
+
+		end := bytes.Index(buf[i+2:], []byte("*/"))
+		if end == -1 {
+			vm.exec_pos = int64(n_line)
+			vm.compile_error("Syntax ERROR: Unterminated block comment")
+		}
+		end += i + 4
+		for ; i < end; i++ {
+			if buf[i] == '\n' {
+				n_line++
+			} else {
+				buf[i] = ' '
+			}
+		}
+		i--
+	}
+	return string(buf)
+}
+
+// Splits line on ';' outside of string literals
+func split_statements(line string) []string {
+	statements := make([]string, 0, 1)
+	var quote rune
+	start := 0
+	for i, c := range line {
+		if quote == 0 {
+			if c == '"' || c == '\'' {
+				quote = c
+			} else if c == ';' {
+				statements = append(statements, line[start:i])
+				start = i + 1
+			}
+		} else if c == quote {
+			quote = 0
+		}
+	}
+	return append(statements, line[start:])
+}
+
+func is_blank(c rune) bool {
+	return c == '\n' || c == '\r' || c == '\t' || c == ' '
+}
+
+// Returns the quote character of a string literal left unterminated in line, or 0
+func open_quote(line string) rune {
+	var quote rune
+	for _, c := range line {
+		if quote == 0 {
+			if c == '"' || c == '\'' {
+				quote = c
+			}
+		} else if c == quote {
+			quote = 0
+		}
+	}
+	return quote
+}
+
+func (vm *IcebergVM) Compile(script string) (code Bytecode, err error) {
+	defer vm.recover_error(&err)
 	program, label_table := vm.parse_script(script)
 	return Bytecode{
 		program,
 		label_table,
+	}, nil
+}
+
+// Same as Compile but panics with *IcebergError on a syntax error
+func (vm *IcebergVM) Gen_bytecode(script string) Bytecode {
+	code, err := vm.Compile(script)
+	if err != nil {
+		panic(err)
 	}
+	return code
 }
 
 func (vm *IcebergVM) Get_argument(arg Entity, type_mask int64) (interface{}, int64) {
-	buf := bytes.NewReader(arg.Data)
 	if arg.E_type == T_UNDET {
-		b_symbol := make([]byte, len(arg.Data))
-		err := binary.Read(buf, binary.LittleEndian, &b_symbol)
-		if err != nil {
-			vm.Runtime_error(fmt.Sprintf("System ERROR: Get_argument() failed. err: %s", err.Error()))
+		sym_value, exist := vm.var_table[string(arg.Data)]
+		if !exist {
+			sym_value, exist = vm.lookup_var(string(arg.Data))
 		}
-		sym_value, exist := vm.var_table[string(b_symbol)]
 		if !exist {
-			vm.Runtime_error(fmt.Sprintf("Argument ERROR: Unbound symbol %s", string(b_symbol)))
+			vm.Runtime_error(fmt.Sprintf("Argument ERROR: Unbound symbol %s", string(arg.Data)))
 		}
 		return vm.Get_argument(sym_value, type_mask)
 	}
 	
 	if arg.E_type & type_mask == 0 {
-		vm.Runtime_error("Type ERROR: Type mismatch")
+		vm.Runtime_error(fmt.Sprintf("Type ERROR: Type mismatch, expected %s but got %s", TypeName(type_mask), TypeName(arg.E_type)))
+	}
+	value, err := decode_entity(arg)
+	if err != nil {
+		vm.Runtime_error(err.Error())
 	}
-	switch arg.E_type {	
+	return value, arg.E_type
+}
+
+// Decodes a non-symbol Entity into the Go value it holds.
+// Reads arg.Data directly instead of through a bytes.Reader since this is on every instruction's path
+func decode_entity(arg Entity) (interface{}, error) {
+	switch arg.E_type {
 	case T_INT:
-		var ret_int int64
-		err := binary.Read(buf, binary.LittleEndian, &ret_int)
-		if err != nil {
-			vm.Runtime_error(fmt.Sprintf("System ERROR: Get_argument() failed. err: %s", err.Error()))
+		if len(arg.Data) >= 8 {
+			return int64(binary.LittleEndian.Uint64(arg.Data)), nil
 		}
-		return ret_int, T_INT
 	case T_FLOAT:
-		var ret_float float64
-		err := binary.Read(buf, binary.LittleEndian, &ret_float)
-		if err != nil {
-			vm.Runtime_error(fmt.Sprintf("System ERROR: Get_argument() failed. err: %s", err.Error()))
+		if len(arg.Data) >= 8 {
+			return math.Float64frombits(binary.LittleEndian.Uint64(arg.Data)), nil
 		}
-		return ret_float, T_FLOAT
 	case T_BOOL:
-		var ret_bool bool
-		err := binary.Read(buf, binary.LittleEndian, &ret_bool)
-		if err != nil {
-			vm.Runtime_error(fmt.Sprintf("System ERROR: Get_argument() failed. err: %s", err.Error()))
-		}
-		return ret_bool, T_BOOL
-	case T_STR:
-		ret_b_str := make([]byte, len(arg.Data))
-		err := binary.Read(buf, binary.LittleEndian, &ret_b_str)
-		if err != nil {
-			vm.Runtime_error(fmt.Sprintf("System ERROR: Get_argument() failed. err: %s", err.Error()))
+		if len(arg.Data) >= 1 {
+			return arg.Data[0] != 0, nil
 		}
-		return string(ret_b_str), T_STR
-	case T_LABEL:
-		ret_b_label := make([]byte, len(arg.Data))
-		err := binary.Read(buf, binary.LittleEndian, &ret_b_label)
-		if err != nil {
-			vm.Runtime_error(fmt.Sprintf("System ERROR: Get_argument() failed. err: %s", err.Error()))
-		}
-		return string(ret_b_label), T_LABEL
+	case T_STR, T_LABEL:
+		return string(arg.Data), nil
+	case T_NIL:
+		return nil, nil
 	default:
-		vm.Runtime_error(fmt.Sprintf("System ERROR: Unknown typeid %d. Maybe incompatible bytecode?", arg.E_type))
+		return nil, fmt.Errorf("System ERROR: Unknown typeid %d. Maybe incompatible bytecode?", arg.E_type)
 	}
-	// It should not happen
-	return nil, T_UNDET
+	return nil, fmt.Errorf("System ERROR: decode_entity() failed. err: %s", io.ErrUnexpectedEOF.Error())
+}
+
+// Like Get_argument but without a type mask, returning an error instead of raising one
+func (vm *IcebergVM) ToGo(e Entity) (interface{}, error) {
+	if e.E_type == T_UNDET {
+		symbol := string(e.Data)
+		sym_value, exist := vm.lookup_var(symbol)
+		if !exist {
+			return nil, new_error(fmt.Sprintf("Argument ERROR: Unbound symbol %s", symbol), vm.exec_pos, false)
+		}
+		e = sym_value
+	}
+	value, err := decode_entity(e)
+	if err != nil {
+		return nil, new_error(err.Error(), vm.exec_pos, false)
+	}
+	return value, nil
 }
 func (vm *IcebergVM) Get_baresymbol(value Entity) string{
 	if value.E_type != T_UNDET {
-		vm.Runtime_error("Type ERROR: Type mismatch")
+		vm.Runtime_error(fmt.Sprintf("Type ERROR: Type mismatch, expected a symbol but got %s", TypeName(value.E_type)))
 	}
 	buf := bytes.NewReader(value.Data)
 	ret_b_sym := make([]byte, len(value.Data))
@@ -378,96 +756,376 @@ func (vm *IcebergVM) Get_baresymbol(value Entity) string{
 	}
 	return string(ret_b_sym)
 }
-func (vm *IcebergVM) itoentity(value interface{}) Entity {
-	buf := new(bytes.Buffer)
-	switch reflect.TypeOf(value).Kind() {
-	case reflect.Int64:
-		err := binary.Write(buf, binary.LittleEndian, value.(int64))
-		if err != nil {
-			vm.Runtime_error(fmt.Sprintf("System ERROR: itoentity() failed. err: %s", err.Error()))
+// Variables in the current scope shadow the ones in outer scopes
+func (vm *IcebergVM) lookup_var(symbol string) (Entity, bool) {
+	value, exist := vm.var_table[symbol]
+	if exist {
+		return value, true
+	}
+	for i := len(vm.scope_stack) - 1; i >= 0; i-- {
+		value, exist = vm.scope_stack[i][symbol]
+		if exist {
+			return value, true
 		}
+	}
+	return Entity{}, false
+}
+func (vm *IcebergVM) chk_strlen(length int) {
+	if vm.MaxStringLen > 0 && length > vm.MaxStringLen {
+		vm.Runtime_error(fmt.Sprintf("System ERROR: String of %d bytes exceeds the limit of %d", length, vm.MaxStringLen))
+	}
+}
+
+func (vm *IcebergVM) itoentity(value interface{}) Entity {
+	// Go nil becomes Iceberg nil
+	if value == nil {
 		return Entity{
-			buf.Bytes(),
-			T_INT,
-		}
-	case reflect.Float64:
-		err := binary.Write(buf, binary.LittleEndian, value.(float64))
-		if err != nil {
-			vm.Runtime_error(fmt.Sprintf("System ERROR: itoentity() failed. err: %s", err.Error()))
+			[]byte{},
+			T_NIL,
 		}
-		return Entity{
-			buf.Bytes(),
-			T_FLOAT,
+	}
+	// Any Go integer or float kind is widened to int64 or float64
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return vm.encode_entity(rv.Int(), T_INT)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if rv.Uint() > math.MaxInt64 {
+			vm.Runtime_error(fmt.Sprintf("Math ERROR: %d overflows int", rv.Uint()))
 		}
+		return vm.encode_entity(int64(rv.Uint()), T_INT)
+	case reflect.Float32, reflect.Float64:
+		return vm.encode_entity(rv.Float(), T_FLOAT)
 	case reflect.Bool:
-		err := binary.Write(buf, binary.LittleEndian, value.(bool))
-		if err != nil {
-			vm.Runtime_error(fmt.Sprintf("System ERROR: itoentity() failed. err: %s", err.Error()))
-		}
-		return Entity{
-			buf.Bytes(),
-			T_BOOL,
-		}
+		return vm.encode_entity(rv.Bool(), T_BOOL)
 	case reflect.String:
-		err := binary.Write(buf, binary.LittleEndian, []byte(value.(string)))
-		if err != nil {
-			vm.Runtime_error(fmt.Sprintf("System ERROR: itoentity() failed. err: %s", err.Error()))
-		}
-		return Entity{
-			buf.Bytes(),
-			T_STR,
-		}
+		vm.chk_strlen(rv.Len())
+		return vm.encode_entity([]byte(rv.String()), T_STR)
 	default:
-		vm.Runtime_error("VM ERROR: Tried to convert a value with type that is not compatible with Iceberg")
+		vm.Runtime_error(fmt.Sprintf("Type ERROR: Go type %T is not compatible with Iceberg", value))
 	}
 	// It should not happen
 	return Entity{}
 }
+func (vm *IcebergVM) encode_entity(value interface{}, e_type int64) Entity {
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.LittleEndian, value)
+	if err != nil {
+		vm.Runtime_error(fmt.Sprintf("System ERROR: itoentity() failed. err: %s", err.Error()))
+	}
+	return Entity{
+		buf.Bytes(),
+		e_type,
+	}
+}
 func (vm *IcebergVM) Assign_var(symbol string, value interface{}) {
-	source := vm.itoentity(value)
+	source := vm.chk_assign(symbol, vm.itoentity(value))
+	vm.account(len(source.Data) - len(vm.var_table[symbol].Data))
+	vm.var_table[symbol] = source
+}
+// Tracks the approximate memory held by the VM, raising an error past MaxMemoryBytes
+func (vm *IcebergVM) account(n_bytes int) {
+	if n_bytes > 0 {
+		vm.chk_memory(n_bytes)
+	}
+	vm.mem_used += int64(n_bytes)
+}
+// Raises the error account would for n_bytes more, without counting them
+func (vm *IcebergVM) chk_memory(n_bytes int) {
+	if vm.MaxMemoryBytes > 0 && vm.mem_used + int64(n_bytes) > vm.MaxMemoryBytes {
+		vm.Runtime_error(fmt.Sprintf("System ERROR: Memory limit of %d bytes exceeded", vm.MaxMemoryBytes))
+	}
+}
+// Checks that source may be stored in symbol, returning the entity to store.
+// nil may replace a value of any type, but the variable keeps that type: the
+// stored nil remembers it, and only a value of that type may replace the nil.
+// A variable that has only held nil takes the type of the first value it gets.
+func (vm *IcebergVM) chk_assign(symbol string, source Entity) Entity {
 	registered, exist := vm.var_table[symbol]
 	if exist {
-		if registered.E_type != source.E_type {
-			vm.Runtime_error("Type ERROR: Type mismatch")
+		var_type := held_type(registered)
+		if var_type != source.E_type && var_type != T_NIL && source.E_type != T_NIL {
+			vm.Runtime_error(fmt.Sprintf("Type ERROR: Type mismatch, %s holds %s but got %s", symbol, TypeName(var_type), TypeName(source.E_type)))
+		}
+		if source.E_type == T_NIL && var_type != T_NIL {
+			data := make([]byte, 8)
+			binary.LittleEndian.PutUint64(data, uint64(var_type))
+			return Entity{
+				data,
+				T_NIL,
+			}
 		}
-		vm.var_table[symbol] = source
 	} else {
 		test_ent := vm.conv_arg([]byte(symbol))
 		if test_ent.E_type != T_UNDET {
 			vm.Runtime_error(fmt.Sprintf("Type ERROR: Invalid symbol name %s", symbol))
 		}
-		vm.var_table[symbol] = source
 	}
+	return source
+}
+// The type of a variable holding e; a nil stored over a typed value still has that type
+func held_type(e Entity) int64 {
+	if e.E_type == T_NIL && len(e.Data) == 8 {
+		return int64(binary.LittleEndian.Uint64(e.Data))
+	}
+	return e.E_type
+}
+
+func (vm *IcebergVM) GetVar(symbol string) (interface{}, bool) {
+	entity, exist := vm.lookup_var(symbol)
+	if !exist {
+		return nil, false
+	}
+	value, err := decode_entity(entity)
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}
+func (vm *IcebergVM) SetVar(symbol string, value interface{}) error {
+	return host_error(vm.catch_error(func() {
+		vm.Assign_var(symbol, value)
+	}))
+}
+// Sets several variables before Run. All of them are checked first, so on error none is set.
+func (vm *IcebergVM) SetInputs(inputs map[string]interface{}) error {
+	symbols := make([]string, 0, len(inputs))
+	for symbol := range inputs {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+
+	// Everything that can fail happens before the first variable is stored
+	sources := make([]Entity, len(symbols))
+	n_bytes := 0
+	err := vm.catch_error(func() {
+		for i, symbol := range symbols {
+			sources[i] = vm.chk_assign(symbol, vm.itoentity(inputs[symbol]))
+			n_bytes += len(sources[i].Data) - len(vm.var_table[symbol].Data)
+		}
+		vm.chk_memory(n_bytes)
+	})
+	if err != nil {
+		return host_error(err)
+	}
+	for i, symbol := range symbols {
+		vm.var_table[symbol] = sources[i]
+	}
+	vm.mem_used += int64(n_bytes)
+	return nil
+}
+// Snapshot of every visible variable, inner scopes shadowing outer ones
+func (vm *IcebergVM) Vars() map[string]interface{} {
+	vars := make(map[string]interface{})
+	scopes := make([]map[string]Entity, 0, len(vm.scope_stack) + 1)
+	scopes = append(scopes, vm.scope_stack...)
+	scopes = append(scopes, vm.var_table)
+	for _, scope := range scopes {
+		for key, entity := range scope {
+			value, err := decode_entity(entity)
+			if err == nil {
+				vars[key] = value
+			}
+		}
+	}
+	return vars
+}
+
+// Marks an error raised during a host API call, where no instruction is running
+func host_error(err error) error {
+	if ice_err, ok := err.(*IcebergError); ok {
+		ice_err.Pos = 0
+		ice_err.Host_call = true
+	}
+	return err
+}
+// An error from a host API call that never reached the VM, such as RegisterInstruction
+func new_host_error(message string) *IcebergError {
+	err := new_error(message, 0, false)
+	err.Host_call = true
+	return err
+}
+// Runs f, returning a raised *IcebergError instead of panicking
+func (vm *IcebergVM) catch_error(f func()) (err error) {
+	defer vm.recover_error(&err)
+	f()
+	return nil
 }
 
 func (vm *IcebergVM) Dump_bytecode(code Bytecode) {
+	out := vm.stdout()
 	for i, instr := range code.inst_list {
-		fmt.Printf("%d: %s ", i, instr.Inst)
+		fmt.Fprintf(out, "%d: %s ", i, instr.Inst)
+		if instr.Inst == "note" && len(instr.Args) == 1 && instr.Args[0].E_type == T_STR {
+			fmt.Fprintf(out, "%q\n", instr.Args[0].Data)
+			continue
+		}
 		for _, arg := range instr.Args {
-			fmt.Printf("%x<type: %d>, ", arg.Data, arg.E_type)
+			fmt.Fprintf(out, "%x<type: %d>, ", arg.Data, arg.E_type)
 		}
-		fmt.Println("")
+		fmt.Fprintln(out, "")
 	}
-	fmt.Println("Label table:")
-	fmt.Println(code.label_table)
+	fmt.Fprintln(out, "Label table:")
+	fmt.Fprintln(out, code.label_table)
+}
+
+func (vm *IcebergVM) Run(code Bytecode) (err error) {
+	return vm.RunContext(context.Background(), code)
 }
 
-func (vm *IcebergVM) Run(code Bytecode) {
+// Like Run, but stops with ctx.Err() once ctx is cancelled
+func (vm *IcebergVM) RunContext(ctx context.Context, code Bytecode) (err error) {
+	vm.chk_copy()
+	defer vm.recover_error(&err)
 	vm.exec_pos = 0
+	vm.jumped = false
+	vm.exit_code = 0
+	// A try left open by an earlier program must not catch errors in this one
+	vm.try_stack = make([]try_handler, 0)
+	vm.inst_list = code.inst_list
 	vm.label_table = code.label_table
-	inst_max := int64(len(code.inst_list) - 1)
+	return vm.run_loop(ctx.Done(), ctx.Err)
+}
+
+// Like Run, but gives up with context.DeadlineExceeded after d
+func (vm *IcebergVM) RunTimeout(d time.Duration, code Bytecode) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return vm.RunContext(ctx, code)
+}
+
+// How many instructions run between checks for cancellation
+const CANCEL_CHECK_INTERVAL = 1024
+
+// Executes vm.inst_list from vm.exec_pos until it runs off the end or done is closed
+func (vm *IcebergVM) run_loop(done <-chan struct{}, cause func() error) error {
+	inst_list := vm.inst_list
+	inst_max := int64(len(inst_list) - 1)
+	countdown := CANCEL_CHECK_INTERVAL
 
 	for ;vm.exec_pos<=inst_max; {
-		instr := code.inst_list[vm.exec_pos]
-		vm.Inst_table[instr.Inst].Function(instr.Args)
-		vm.exec_pos++
+		vm.exec_instr(inst_list[vm.exec_pos])
+		if vm.jumped {
+			vm.jumped = false
+		} else {
+			vm.exec_pos++
+		}
+
+		countdown--
+		if countdown == 0 {
+			countdown = CANCEL_CHECK_INTERVAL
+			select {
+			case <-done:
+				return cause()
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+// Compiles one line onto a program kept across calls and executes it, for
+// interactive use. Variables are shared with Run; the program and its labels
+// are not, so a goto can only reach labels defined by earlier EvalLine calls.
+func (vm *IcebergVM) EvalLine(line string) error {
+	vm.chk_copy()
+	if vm.eval_labels == nil {
+		vm.eval_labels = make(map[string]int64)
+	}
+	return vm.catch_error(func() {
+		start := len(vm.eval_list)
+		// Compile errors report line 1, the only line there is
+		vm.exec_pos = 0
+		program := vm.eval_list
+		for _, statement := range split_statements(vm.strip_comments(line)) {
+			program = vm.parse_oneline(strings.TrimFunc(statement, is_blank), program)
+		}
+		vm.exec_pos = int64(start)
+		for i := start; i < len(program); i++ {
+			if strings.IndexRune(program[i].Inst, '@') == 0 {
+				vm.eval_labels[program[i].Inst] = int64(i)
+				program[i].Inst = "nop"
+			}
+		}
+		vm.eval_list = program
+
+		vm.jumped = false
+		vm.inst_list = vm.eval_list
+		vm.label_table = vm.eval_labels
+		vm.run_loop(nil, nil)
+	})
+}
+
+// Status given to exit by the last program run, or 0 if it did not call exit.
+// exit is a clean stop, so Run returns nil for it whatever the code.
+func (vm *IcebergVM) ExitCode() int64 {
+	return vm.exit_code
+}
+
+func (vm *IcebergVM) chk_copy() {
+	if vm.self != vm {
+		panic("iceberg: IcebergVM used without Init or copied by value after Init; use Clone to copy")
+	}
+}
+
+// The next instruction executed is exactly the one at prog_idx
+func (vm *IcebergVM) jump_to(prog_idx int64) {
+	vm.exec_pos = prog_idx
+	vm.jumped = true
+}
+
+func (vm *IcebergVM) recover_error(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	ice_err, ok := r.(*IcebergError)
+	if !ok {
+		panic(r)
+	}
+	*err = ice_err
+}
+
+func (vm *IcebergVM) exec_instr(instr instruction) {
+	if len(vm.try_stack) > 0 {
+		defer vm.catch_fault()
+	}
+	vm.Inst_table[instr.Inst].Function(instr.Args)
+}
+
+// Unwinds to the innermost try handler and jumps to its label
+func (vm *IcebergVM) catch_fault() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	ice_err, ok := r.(*IcebergError)
+	n_handlers := len(vm.try_stack)
+	if !ok || n_handlers == 0 {
+		panic(r)
+	}
+	handler := vm.try_stack[n_handlers-1]
+	prog_idx, exist := vm.label_table[handler.label]
+	if !exist {
+		panic(r)
+	}
+	vm.try_stack = vm.try_stack[:n_handlers-1]
+	for len(vm.scope_stack) > handler.n_scopes {
+		vm.inst_popscope([]Entity{})
 	}
+	vm.Assign_var(handler.err_symbol, ice_err.Message)
+	vm.jump_to(prog_idx)
 }
 
 func (vm *IcebergVM) inst_nop(args []Entity) {
 	
 }
 
+// Does nothing; the text annotates the bytecode and shows up in Dump_bytecode
+func (vm *IcebergVM) inst_note(args []Entity) {
+	vm.Get_argument(args[0], T_STR)
+}
+
 func (vm *IcebergVM) inst_let(args []Entity) {
 	sym_name := vm.Get_baresymbol(args[0])
 	value, _ := vm.Get_argument(args[1], T_ANY)
@@ -476,16 +1134,12 @@ func (vm *IcebergVM) inst_let(args []Entity) {
 
 func (vm *IcebergVM) arb_calc(args []Entity, operator string) {
 	ope_a, type_a := vm.Get_argument(args[0], T_INT | T_FLOAT)
-	ope_b, _ := vm.Get_argument(args[1], type_a)
+	ope_b, type_b := vm.Get_argument(args[1], T_INT | T_FLOAT)
 
-	var ope_a_s, ope_b_s float64
-	if type_a == T_INT {
-		ope_a_s = float64(ope_a.(int64))
-		ope_b_s = float64(ope_b.(int64))
-	} else {
-		ope_a_s = ope_a.(float64)
-		ope_b_s = ope_b.(float64)
-	}
+	// An int mixed with a float is promoted, giving a float result
+	ope_a_s := to_float(ope_a, type_a)
+	ope_b_s := to_float(ope_b, type_b)
+	both_int := type_a == T_INT && type_b == T_INT
 
 	var is_divr bool
 	var source float64
@@ -511,7 +1165,11 @@ func (vm *IcebergVM) arb_calc(args []Entity, operator string) {
 		if ope_b_s == 0 {
 			vm.Runtime_error("Math ERROR: Division by zero")
 		}
-		source = float64(int64(ope_a_s) % int64(ope_b_s))
+		if both_int {
+			source = float64(ope_a.(int64) % ope_b.(int64))
+		} else {
+			source = math.Mod(ope_a_s, ope_b_s)
+		}
 	case "**":
 		source = math.Pow(ope_a_s, ope_b_s)
 	default:
@@ -519,9 +1177,10 @@ func (vm *IcebergVM) arb_calc(args []Entity, operator string) {
 	}
 
 	var ans interface{}
-	if type_a == T_INT && !is_divr {
+	if both_int && !is_divr {
 		ans = int64(source)
 	} else {
+		vm.chk_float(source)
 		ans = source
 	}
 
@@ -529,6 +1188,19 @@ func (vm *IcebergVM) arb_calc(args []Entity, operator string) {
 	vm.Assign_var(sym_name, ans)
 }
 
+// With StrictFloat, NaN and infinite results are errors instead of values
+func (vm *IcebergVM) chk_float(value float64) {
+	if !vm.StrictFloat {
+		return
+	}
+	if math.IsNaN(value) {
+		vm.Runtime_error("Math ERROR: Result is NaN")
+	}
+	if math.IsInf(value, 0) {
+		vm.Runtime_error("Math ERROR: Result is infinite")
+	}
+}
+
 func (vm *IcebergVM) inst_add(args []Entity) {
 	vm.arb_calc(args, "+")
 }
@@ -550,11 +1222,153 @@ func (vm *IcebergVM) inst_mod(args []Entity) {
 func (vm *IcebergVM) inst_pow(args []Entity) {
 	vm.arb_calc(args, "**")
 }
+func (vm *IcebergVM) inst_hypot(args []Entity) {
+	ope_a, type_a := vm.Get_argument(args[0], T_INT | T_FLOAT)
+	ope_b, type_b := vm.Get_argument(args[1], T_INT | T_FLOAT)
+
+	var ope_a_s, ope_b_s float64
+	if type_a == T_INT {
+		ope_a_s = float64(ope_a.(int64))
+	} else {
+		ope_a_s = ope_a.(float64)
+	}
+	if type_b == T_INT {
+		ope_b_s = float64(ope_b.(int64))
+	} else {
+		ope_b_s = ope_b.(float64)
+	}
+
+	source := math.Hypot(ope_a_s, ope_b_s)
+	vm.chk_float(source)
+	sym_name := vm.Get_baresymbol(args[2])
+	vm.Assign_var(sym_name, source)
+}
+
+func (vm *IcebergVM) inst_powmod(args []Entity) {
+	base, _ := vm.Get_argument(args[0], T_INT)
+	exponent, _ := vm.Get_argument(args[1], T_INT)
+	modulus, _ := vm.Get_argument(args[2], T_INT)
+
+	if exponent.(int64) < 0 {
+		vm.Runtime_error("Math ERROR: Negative exponent")
+	}
+	if modulus.(int64) <= 0 {
+		vm.Runtime_error("Math ERROR: Modulus must be positive")
+	}
+	// math/big keeps the intermediate powers from overflowing
+	source := new(big.Int).Exp(big.NewInt(base.(int64)), big.NewInt(exponent.(int64)), big.NewInt(modulus.(int64)))
+	sym_name := vm.Get_baresymbol(args[3])
+	vm.Assign_var(sym_name, source.Int64())
+}
+
+func (vm *IcebergVM) arb_divisor(args []Entity, operator string) {
+	ope_a, _ := vm.Get_argument(args[0], T_INT)
+	ope_b, _ := vm.Get_argument(args[1], T_INT)
+
+	abs_a := abs_u64(ope_a.(int64))
+	abs_b := abs_u64(ope_b.(int64))
+	// Euclidean algorithm
+	gcd := abs_a
+	for rem := abs_b; rem != 0; {
+		gcd, rem = rem, gcd % rem
+	}
+
+	var source uint64
+	switch operator {
+	case "gcd":
+		source = gcd
+	case "lcm":
+		if gcd != 0 {
+			quot := abs_a / gcd
+			if abs_b != 0 && quot > math.MaxInt64 / abs_b {
+				vm.Runtime_error("Math ERROR: Integer overflow")
+			}
+			source = quot * abs_b
+		}
+	default:
+		vm.Runtime_error(fmt.Sprintf("System ERROR: Unknown operator %s Possibly a bug in VM", operator))
+	}
+	if source > math.MaxInt64 {
+		vm.Runtime_error("Math ERROR: Integer overflow")
+	}
+	sym_name := vm.Get_baresymbol(args[2])
+	vm.Assign_var(sym_name, int64(source))
+}
+func abs_u64(value int64) uint64 {
+	if value < 0 {
+		return uint64(-value)
+	}
+	return uint64(value)
+}
+func (vm *IcebergVM) inst_gcd(args []Entity) {
+	vm.arb_divisor(args, "gcd")
+}
+func (vm *IcebergVM) inst_lcm(args []Entity) {
+	vm.arb_divisor(args, "lcm")
+}
+
+func (vm *IcebergVM) inst_sign(args []Entity) {
+	operand, type_o := vm.Get_argument(args[0], T_INT | T_FLOAT)
 
+	var operand_s float64
+	if type_o == T_INT {
+		operand_s = float64(operand.(int64))
+	} else {
+		operand_s = operand.(float64)
+	}
+
+	var source int64
+	if math.IsNaN(operand_s) {
+		vm.Runtime_error("Math ERROR: sign of NaN")
+	} else if operand_s > 0 {
+		source = 1
+	} else if operand_s < 0 {
+		source = -1
+	}
+	sym_name := vm.Get_baresymbol(args[1])
+	vm.Assign_var(sym_name, source)
+}
+
+func (vm *IcebergVM) arb_float_pred(args []Entity, predicate string) {
+	operand, type_o := vm.Get_argument(args[0], T_INT | T_FLOAT)
+
+	var source bool
+	if type_o == T_INT {
+		vm.Runtime_warning(fmt.Sprintf("%s of T_INT is always false", predicate))
+	} else {
+		switch predicate {
+		case "isnan":
+			source = math.IsNaN(operand.(float64))
+		case "isinf":
+			source = math.IsInf(operand.(float64), 0)
+		default:
+			vm.Runtime_error(fmt.Sprintf("System ERROR: Unknown predicate %s Possibly a bug in VM", predicate))
+		}
+	}
+	sym_name := vm.Get_baresymbol(args[1])
+	vm.Assign_var(sym_name, source)
+}
+func (vm *IcebergVM) inst_isnan(args []Entity) {
+	vm.arb_float_pred(args, "isnan")
+}
+func (vm *IcebergVM) inst_isinf(args []Entity) {
+	vm.arb_float_pred(args, "isinf")
+}
+
+func to_float(operand interface{}, type_o int64) float64 {
+	if type_o == T_INT {
+		return float64(operand.(int64))
+	}
+	return operand.(float64)
+}
 func (vm *IcebergVM) inst_cmp(args []Entity) {
-	ope_a, type_a := vm.Get_argument(args[0], T_ANY ^ T_BOOL ^ T_LABEL)
+	ope_a, type_a := vm.Get_argument(args[0], T_ANY ^ T_BOOL ^ T_LABEL ^ T_NIL)
 	ope_b, _ := vm.Get_argument(args[1], T_STR)
-	ope_c, _ := vm.Get_argument(args[2], type_a)
+	type_mask := type_a
+	if type_a != T_STR {
+		type_mask = T_INT | T_FLOAT
+	}
+	ope_c, type_c := vm.Get_argument(args[2], type_mask)
 
 	var source bool
 	if type_a == T_STR {
@@ -572,32 +1386,38 @@ func (vm *IcebergVM) inst_cmp(args []Entity) {
 		case "!=":
 			source = ope_a.(string) != ope_c.(string)
 		default:
-			vm.Runtime_error(fmt.Sprintf("Argument ERROR: Unknown oeprator %s", ope_b.(string)))
+			vm.Runtime_error(fmt.Sprintf("Argument ERROR: Unknown operator %s", ope_b.(string)))
 		}
 	} else {
-		var ope_a_s, ope_c_s float64
-		if type_a == T_INT {
-			ope_a_s = float64(ope_a.(int64))
-			ope_c_s = float64(ope_c.(int64))
+		// Two ints compare exactly; an int against a float compares as floats.
+		// Against NaN only != holds.
+		var less, equal, greater bool
+		if type_a == T_INT && type_c == T_INT {
+			less = ope_a.(int64) < ope_c.(int64)
+			equal = ope_a.(int64) == ope_c.(int64)
+			greater = ope_a.(int64) > ope_c.(int64)
 		} else {
-			ope_a_s = ope_a.(float64)
-			ope_c_s = ope_c.(float64)
+			ope_a_s := to_float(ope_a, type_a)
+			ope_c_s := to_float(ope_c, type_c)
+			less = ope_a_s < ope_c_s
+			equal = ope_a_s == ope_c_s
+			greater = ope_a_s > ope_c_s
 		}
 		switch ope_b.(string) {
 		case ">":
-			source = ope_a_s > ope_c_s
+			source = greater
 		case ">=":
-			source = ope_a_s >= ope_c_s
+			source = greater || equal
 		case "==":
-			source = ope_a_s == ope_c_s
+			source = equal
 		case "<=":
-			source = ope_a_s <= ope_c_s
+			source = less || equal
 		case "<":
-			source = ope_a_s < ope_c_s
+			source = less
 		case "!=":
-			source = ope_a_s != ope_c_s
+			source = !equal
 		default:
-			vm.Runtime_error(fmt.Sprintf("Argument ERROR: Unknown oeprator %x, %x", ope_b.(string), "<"))
+			vm.Runtime_error(fmt.Sprintf("Argument ERROR: Unknown operator %s", ope_b.(string)))
 		}
 	}
 	sym_name := vm.Get_baresymbol(args[3])
@@ -644,7 +1464,15 @@ func (vm *IcebergVM) inst_int(args []Entity) {
 		vm.Runtime_warning("Unnecessary cast T_INT->T_INT")
 		source = operand.(int64)
 	} else {
-		source = int64(operand.(float64))
+		// Truncates toward zero; float64(math.MaxInt64) is 2^63, already out of range
+		value := operand.(float64)
+		if math.IsNaN(value) {
+			vm.Runtime_error("Math ERROR: Cannot convert NaN to int")
+		}
+		if value >= math.MaxInt64 || value < math.MinInt64 {
+			vm.Runtime_error(fmt.Sprintf("Math ERROR: %g is out of the int range", value))
+		}
+		source = int64(value)
 	}
 	sym_name := vm.Get_baresymbol(args[0])
 	vm.Assign_var(sym_name, source)
@@ -676,6 +1504,8 @@ func (vm *IcebergVM) inst_bool(args []Entity) {
 		source = operand.(bool)
 	case T_STR:
 		source = operand.(string) != ""
+	case T_NIL:
+		source = false
 	}
 	sym_name := vm.Get_baresymbol(args[0])
 	vm.Assign_var(sym_name, source)
@@ -683,27 +1513,202 @@ func (vm *IcebergVM) inst_bool(args []Entity) {
 func (vm *IcebergVM) inst_str(args []Entity) {
 	operand, type_o := vm.Get_argument(args[1], T_ANY ^ T_LABEL)
 
+	if type_o == T_STR {
+		vm.Runtime_warning("Unnecessary cast T_STR->T_STR")
+	}
+	sym_name := vm.Get_baresymbol(args[0])
+	vm.Assign_var(sym_name, vm.stringify(operand, type_o))
+}
+// 64-bit FNV-1a of the string's UTF-8 bytes, the same on every platform
+func fnv1a(str string) uint64 {
+	h := fnv.New64a()
+	io.WriteString(h, str)
+	return h.Sum64()
+}
+// hash str, dest; the hash as int, wrapping into the negatives above 2^63-1
+func (vm *IcebergVM) inst_hash(args []Entity) {
+	operand, _ := vm.Get_argument(args[0], T_STR)
+	sym_name := vm.Get_baresymbol(args[1])
+	vm.Assign_var(sym_name, int64(fnv1a(operand.(string))))
+}
+// hashstr str, dest; the hash as 16 lowercase hex digits
+func (vm *IcebergVM) inst_hashstr(args []Entity) {
+	operand, _ := vm.Get_argument(args[0], T_STR)
+	sym_name := vm.Get_baresymbol(args[1])
+	vm.Assign_var(sym_name, fmt.Sprintf("%016x", fnv1a(operand.(string))))
+}
+// parseintbase str, base, dest, ok; base 0 picks it from a 0x, 0o or 0b prefix.
+// On failure dest is 0 and ok is false.
+func (vm *IcebergVM) inst_parseintbase(args []Entity) {
+	operand, _ := vm.Get_argument(args[0], T_STR)
+	base, _ := vm.Get_argument(args[1], T_INT)
+	if base.(int64) != 0 && (base.(int64) < 2 || base.(int64) > 36) {
+		vm.Runtime_error(fmt.Sprintf("Argument ERROR: Base must be 0 or between 2 and 36, got %d", base.(int64)))
+	}
+
+	value, err := strconv.ParseInt(operand.(string), int(base.(int64)), 64)
+	if err != nil {
+		value = 0
+	}
+	vm.Assign_var(vm.Get_baresymbol(args[2]), value)
+	vm.Assign_var(vm.Get_baresymbol(args[3]), err == nil)
+}
+// hexencode str, dest; two lowercase hex digits per byte
+func (vm *IcebergVM) inst_hexencode(args []Entity) {
+	operand, _ := vm.Get_argument(args[0], T_STR)
+	sym_name := vm.Get_baresymbol(args[1])
+	vm.Assign_var(sym_name, hex.EncodeToString([]byte(operand.(string))))
+}
+// hexdecode str, dest; either case is accepted
+func (vm *IcebergVM) inst_hexdecode(args []Entity) {
+	operand, _ := vm.Get_argument(args[0], T_STR)
+	decoded, err := hex.DecodeString(operand.(string))
+	if err != nil {
+		vm.Runtime_error(fmt.Sprintf("Argument ERROR: hexdecode failed. err: %s", err.Error()))
+	}
+	sym_name := vm.Get_baresymbol(args[1])
+	vm.Assign_var(sym_name, string(decoded))
+}
+// Most compiled patterns kept at once; the cache starts over when it fills up
+const REGEX_CACHE_SIZE = 256
+
+func (vm *IcebergVM) regex(pattern string) *regexp.Regexp {
+	re, exist := vm.regex_cache[pattern]
+	if exist {
+		return re
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		vm.Runtime_error(fmt.Sprintf("Argument ERROR: Invalid pattern %q. err: %s", pattern, err.Error()))
+	}
+	if vm.regex_cache == nil || len(vm.regex_cache) >= REGEX_CACHE_SIZE {
+		vm.regex_cache = make(map[string]*regexp.Regexp)
+	}
+	vm.regex_cache[pattern] = re
+	return re
+}
+// match pattern, str, dest; true if the pattern matches anywhere in str
+func (vm *IcebergVM) inst_match(args []Entity) {
+	pattern, _ := vm.Get_argument(args[0], T_STR)
+	input, _ := vm.Get_argument(args[1], T_STR)
+
+	sym_name := vm.Get_baresymbol(args[2])
+	vm.Assign_var(sym_name, vm.regex(pattern.(string)).MatchString(input.(string)))
+}
+// capture pattern, str, group, dest; group 0 is the whole match. Assigns "" when
+// nothing matches or the group took no part in the match.
+func (vm *IcebergVM) inst_capture(args []Entity) {
+	pattern, _ := vm.Get_argument(args[0], T_STR)
+	input, _ := vm.Get_argument(args[1], T_STR)
+	group, _ := vm.Get_argument(args[2], T_INT)
+
+	re := vm.regex(pattern.(string))
+	if group.(int64) < 0 || group.(int64) > int64(re.NumSubexp()) {
+		vm.Runtime_error(fmt.Sprintf("Argument ERROR: Group %d out of range, pattern has %d groups", group.(int64), re.NumSubexp()))
+	}
+	captured := ""
+	submatch := re.FindStringSubmatch(input.(string))
+	if submatch != nil {
+		captured = submatch[group.(int64)]
+	}
+	sym_name := vm.Get_baresymbol(args[3])
+	vm.Assign_var(sym_name, captured)
+}
+// regexreplace pattern, str, template, dest; $1 or ${name} in template insert groups
+func (vm *IcebergVM) inst_regexreplace(args []Entity) {
+	pattern, _ := vm.Get_argument(args[0], T_STR)
+	input, _ := vm.Get_argument(args[1], T_STR)
+	template, _ := vm.Get_argument(args[2], T_STR)
+
+	sym_name := vm.Get_baresymbol(args[3])
+	vm.Assign_var(sym_name, vm.regex(pattern.(string)).ReplaceAllString(input.(string), template.(string)))
+}
+// fmtfloat value, precision, dest; fixed-point with precision decimals
+func (vm *IcebergVM) inst_fmtfloat(args []Entity) {
+	operand, _ := vm.Get_argument(args[0], T_FLOAT)
+	precision, _ := vm.Get_argument(args[1], T_INT)
+	if precision.(int64) < 0 || precision.(int64) > 1000 {
+		vm.Runtime_error(fmt.Sprintf("Argument ERROR: Precision must be between 0 and 1000, got %d", precision.(int64)))
+	}
+
+	sym_name := vm.Get_baresymbol(args[2])
+	vm.Assign_var(sym_name, strconv.FormatFloat(operand.(float64), 'f', int(precision.(int64)), 64))
+}
+// fmtint value, base, dest; digits above 9 are lowercase letters
+func (vm *IcebergVM) inst_fmtint(args []Entity) {
+	operand, _ := vm.Get_argument(args[0], T_INT)
+	base, _ := vm.Get_argument(args[1], T_INT)
+	if base.(int64) < 2 || base.(int64) > 36 {
+		vm.Runtime_error(fmt.Sprintf("Argument ERROR: Base must be between 2 and 36, got %d", base.(int64)))
+	}
+
+	sym_name := vm.Get_baresymbol(args[2])
+	vm.Assign_var(sym_name, strconv.FormatInt(operand.(int64), int(base.(int64))))
+}
+// reprfloat value, dest; shortest round-tripping form, with an exponent for very
+// large or small values (1e+20 rather than str's 100000000000000000000)
+func (vm *IcebergVM) inst_reprfloat(args []Entity) {
+	operand, _ := vm.Get_argument(args[0], T_FLOAT)
+	sym_name := vm.Get_baresymbol(args[1])
+	vm.Assign_var(sym_name, with_point(strconv.FormatFloat(operand.(float64), 'g', -1, 64)))
+}
+// boolstr value, dest; "1" for true and "0" for false
+func (vm *IcebergVM) inst_boolstr(args []Entity) {
+	operand, _ := vm.Get_argument(args[0], T_BOOL)
+	source := "0"
+	if operand.(bool) {
+		source = "1"
+	}
+	sym_name := vm.Get_baresymbol(args[1])
+	vm.Assign_var(sym_name, source)
+}
+// Appends ".0" to a formatted float that would otherwise read back as an int
+func with_point(source string) string {
+	if strings.ContainsAny(source, ".eEIN") {
+		return source
+	}
+	return source + ".0"
+}
+// Text used by str, print and cat-like output. Floats are written in plain
+// decimal notation with as many digits as needed to read back the same value,
+// and always with a decimal point so 2.0 stays a float ("2.0", not "2").
+func (vm *IcebergVM) stringify(operand interface{}, type_o int64) string {
 	var source string
 	switch type_o {
 	case T_INT:
 		source = strconv.FormatInt(operand.(int64), 10)
 	case T_FLOAT:
-		source = strconv.FormatFloat(operand.(float64), 'f', -1, 64)
+		source = with_point(strconv.FormatFloat(operand.(float64), 'f', -1, 64))
 	case T_BOOL:
 		if operand.(bool) {
-			source = "false"
-		} else {
 			source = "true"
+		} else {
+			source = "false"
 		}
 	case T_STR:
-		vm.Runtime_warning("Unnecessary cast T_STR->T_STR")
 		source = operand.(string)
+	case T_NIL:
+		source = "nil"
 	}
-	sym_name := vm.Get_baresymbol(args[0])
-	vm.Assign_var(sym_name, source)
+	return source
 }
 
 func (vm *IcebergVM) inst_cat(args []Entity) {
+	// Appending onto the destination itself grows its buffer in place,
+	// so building a string in a loop stays linear
+	if args[0].E_type == T_UNDET && args[2].E_type == T_UNDET && bytes.Equal(args[0].Data, args[2].Data) {
+		sym_name := string(args[2].Data)
+		dest, exist := vm.var_table[sym_name]
+		if exist && dest.E_type == T_STR {
+			ope_b, _ := vm.Get_argument(args[1], T_STR)
+			vm.chk_strlen(len(dest.Data) + len(ope_b.(string)))
+			vm.account(len(ope_b.(string)))
+			dest.Data = append(dest.Data, ope_b.(string)...)
+			vm.var_table[sym_name] = dest
+			return
+		}
+	}
+
 	ope_a, _ := vm.Get_argument(args[0], T_STR)
 	ope_b, _ := vm.Get_argument(args[1], T_STR)
 
@@ -711,6 +1716,111 @@ func (vm *IcebergVM) inst_cat(args []Entity) {
 	vm.Assign_var(sym_name, ope_a.(string) + ope_b.(string))
 }
 
+// deepequal a, b, dest; true only when both have the same type and value,
+// so 1 and 1.0 differ. Floats compare as numbers: NaN never equals itself.
+func (vm *IcebergVM) inst_deepequal(args []Entity) {
+	ope_a, type_a := vm.Get_argument(args[0], T_ANY ^ T_LABEL)
+	ope_b, type_b := vm.Get_argument(args[1], T_ANY ^ T_LABEL)
+
+	sym_name := vm.Get_baresymbol(args[2])
+	vm.Assign_var(sym_name, type_a == type_b && ope_a == ope_b)
+}
+
+// isnil value, dest; true if value is nil
+func (vm *IcebergVM) inst_isnil(args []Entity) {
+	_, type_o := vm.Get_argument(args[0], T_ANY ^ T_LABEL)
+	sym_name := vm.Get_baresymbol(args[1])
+	vm.Assign_var(sym_name, type_o == T_NIL)
+}
+
+// bytelen str, dest; counts bytes of the UTF-8 encoding, where charat and
+// padleft/padright count characters, so "é" is 2 bytes but 1 character
+func (vm *IcebergVM) inst_bytelen(args []Entity) {
+	source, _ := vm.Get_argument(args[0], T_STR)
+	sym_name := vm.Get_baresymbol(args[1])
+	vm.Assign_var(sym_name, int64(len(source.(string))))
+}
+
+// charat str, index, dest; index counts runes, not bytes
+func (vm *IcebergVM) inst_charat(args []Entity) {
+	source, _ := vm.Get_argument(args[0], T_STR)
+	index, _ := vm.Get_argument(args[1], T_INT)
+
+	n_chars := int64(0)
+	for _, c := range source.(string) {
+		if n_chars == index.(int64) {
+			sym_name := vm.Get_baresymbol(args[2])
+			vm.Assign_var(sym_name, string(c))
+			return
+		}
+		n_chars++
+	}
+	vm.Runtime_error(fmt.Sprintf("Argument ERROR: Index %d out of range for a string of %d characters", index.(int64), utf8.RuneCountInString(source.(string))))
+}
+
+// padleft/padright str, width, [pad,] dest; pads with spaces when pad is omitted
+func (vm *IcebergVM) arb_pad(args []Entity, left bool) {
+	source, _ := vm.Get_argument(args[0], T_STR)
+	width, _ := vm.Get_argument(args[1], T_INT)
+	pad := " "
+	if len(args) == 4 {
+		operand, _ := vm.Get_argument(args[2], T_STR)
+		pad = operand.(string)
+		if utf8.RuneCountInString(pad) != 1 {
+			vm.Runtime_error(fmt.Sprintf("Argument ERROR: Pad must be a single character, got %q", pad))
+		}
+	}
+
+	result := source.(string)
+	n_pad := width.(int64) - int64(utf8.RuneCountInString(result))
+	if n_pad > math.MaxInt32 {
+		vm.Runtime_error(fmt.Sprintf("Argument ERROR: Width %d is too large", width.(int64)))
+	}
+	if n_pad > 0 {
+		vm.chk_strlen(len(result) + int(n_pad) * len(pad))
+		if left {
+			result = strings.Repeat(pad, int(n_pad)) + result
+		} else {
+			result = result + strings.Repeat(pad, int(n_pad))
+		}
+	}
+	sym_name := vm.Get_baresymbol(args[len(args)-1])
+	vm.Assign_var(sym_name, result)
+}
+func (vm *IcebergVM) inst_padleft(args []Entity) {
+	vm.arb_pad(args, true)
+}
+func (vm *IcebergVM) inst_padright(args []Entity) {
+	vm.arb_pad(args, false)
+}
+
+// select cond, then, else, dest
+func (vm *IcebergVM) inst_select(args []Entity) {
+	criteria, _ := vm.Get_argument(args[0], T_BOOL)
+	ope_then, type_then := vm.Get_argument(args[1], T_ANY ^ T_LABEL)
+	ope_else, type_else := vm.Get_argument(args[2], T_ANY ^ T_LABEL)
+	if type_then != type_else {
+		vm.Runtime_error(fmt.Sprintf("Type ERROR: Type mismatch, expected %s but got %s", TypeName(type_then), TypeName(type_else)))
+	}
+
+	sym_name := vm.Get_baresymbol(args[3])
+	if criteria.(bool) {
+		vm.Assign_var(sym_name, ope_then)
+	} else {
+		vm.Assign_var(sym_name, ope_else)
+	}
+}
+
+// exit [code]; stops the program, code defaults to 0
+func (vm *IcebergVM) inst_exit(args []Entity) {
+	vm.exit_code = 0
+	if len(args) == 1 {
+		code, _ := vm.Get_argument(args[0], T_INT)
+		vm.exit_code = code.(int64)
+	}
+	vm.jump_to(int64(len(vm.inst_list)))
+}
+
 func (vm *IcebergVM) inst_goto(args []Entity) {
 	operand, _ := vm.Get_argument(args[0], T_LABEL)
 
@@ -718,7 +1828,7 @@ func (vm *IcebergVM) inst_goto(args []Entity) {
 	if !exist {
 		vm.Runtime_error(fmt.Sprintf("Argument ERROR: Unset label %s", operand.(string)))
 	}
-	vm.exec_pos = prog_idx
+	vm.jump_to(prog_idx)
 }
 func (vm *IcebergVM) inst_when(args []Entity) {
 	operand, _ := vm.Get_argument(args[1], T_LABEL)
@@ -729,53 +1839,504 @@ func (vm *IcebergVM) inst_when(args []Entity) {
 		vm.Runtime_error(fmt.Sprintf("Argument ERROR: Unset label %s", operand.(string)))
 	}
 	if criteria.(bool) {
-		vm.exec_pos = prog_idx
+		vm.jump_to(prog_idx)
+	}
+}
+func (vm *IcebergVM) inst_jump(args []Entity) {
+	operand, _ := vm.Get_argument(args[0], T_STR)
+
+	prog_idx, exist := vm.label_table[operand.(string)]
+	if !exist {
+		vm.Runtime_error(fmt.Sprintf("Argument ERROR: Unset label %s", operand.(string)))
+	}
+	vm.jump_to(prog_idx)
+}
+func (vm *IcebergVM) inst_labeladdr(args []Entity) {
+	operand, _ := vm.Get_argument(args[0], T_LABEL)
+
+	prog_idx, exist := vm.label_table[operand.(string)]
+	if !exist {
+		vm.Runtime_error(fmt.Sprintf("Argument ERROR: Unset label %s", operand.(string)))
+	}
+	sym_name := vm.Get_baresymbol(args[1])
+	vm.Assign_var(sym_name, prog_idx)
+}
+// Jumps to the instruction at the given index, so gotoidx on a labeladdr
+// result behaves exactly as goto on that label
+func (vm *IcebergVM) inst_gotoidx(args []Entity) {
+	operand, _ := vm.Get_argument(args[0], T_INT)
+
+	prog_idx := operand.(int64)
+	if prog_idx < 0 || prog_idx >= int64(len(vm.inst_list)) {
+		vm.Runtime_error(fmt.Sprintf("Argument ERROR: Instruction index %d out of range", prog_idx))
+	}
+	vm.jump_to(prog_idx)
+}
+// Assigns the index of the here instruction itself, so gotoidx on it runs the here again
+func (vm *IcebergVM) inst_here(args []Entity) {
+	sym_name := vm.Get_baresymbol(args[0])
+	vm.Assign_var(sym_name, vm.exec_pos)
+}
+// Jumps offset instructions from the jmprel itself: 1 is the next instruction,
+// 0 is the jmprel again and -1 the one before it. Labels count as instructions.
+func (vm *IcebergVM) inst_jmprel(args []Entity) {
+	operand, _ := vm.Get_argument(args[0], T_INT)
+
+	offset := operand.(int64)
+	if offset < -vm.exec_pos || offset >= int64(len(vm.inst_list)) - vm.exec_pos {
+		vm.Runtime_error(fmt.Sprintf("Argument ERROR: Relative jump %d from instruction %d out of range", offset, vm.exec_pos))
+	}
+	vm.jump_to(vm.exec_pos + offset)
+}
+func (vm *IcebergVM) inst_try(args []Entity) {
+	operand, _ := vm.Get_argument(args[0], T_LABEL)
+	_, exist := vm.label_table[operand.(string)]
+	if !exist {
+		vm.Runtime_error(fmt.Sprintf("Argument ERROR: Unset label %s", operand.(string)))
+	}
+	vm.try_stack = append(vm.try_stack, try_handler{
+		operand.(string),
+		vm.Get_baresymbol(args[1]),
+		len(vm.scope_stack),
+	})
+}
+func (vm *IcebergVM) inst_endtry(args []Entity) {
+	n_handlers := len(vm.try_stack)
+	if n_handlers == 0 {
+		vm.Runtime_error("VM ERROR: endtry without matching try")
+	}
+	vm.try_stack = vm.try_stack[:n_handlers-1]
+}
+
+func (vm *IcebergVM) inst_pushscope(args []Entity) {
+	vm.scope_stack = append(vm.scope_stack, vm.var_table)
+	vm.var_table = make(map[string]Entity)
+}
+func (vm *IcebergVM) inst_popscope(args []Entity) {
+	n_scopes := len(vm.scope_stack)
+	if n_scopes == 0 {
+		vm.Runtime_error("VM ERROR: popscope without matching pushscope")
+	}
+	for _, value := range vm.var_table {
+		vm.account(-len(value.Data))
 	}
+	vm.var_table = vm.scope_stack[n_scopes-1]
+	vm.scope_stack = vm.scope_stack[:n_scopes-1]
+}
+
+func (vm *IcebergVM) inst_push(args []Entity) {
+	operand, _ := vm.Get_argument(args[0], T_ANY ^ T_LABEL)
+	value := vm.itoentity(operand)
+	vm.account(len(value.Data))
+	vm.value_stack = append(vm.value_stack, value)
+}
+func (vm *IcebergVM) inst_pop(args []Entity) {
+	depth := len(vm.value_stack)
+	if depth == 0 {
+		vm.Runtime_error("VM ERROR: pop from empty stack")
+	}
+	value, _ := vm.Get_argument(vm.value_stack[depth-1], T_ANY)
+	vm.account(-len(vm.value_stack[depth-1].Data))
+	vm.value_stack = vm.value_stack[:depth-1]
+	sym_name := vm.Get_baresymbol(args[0])
+	vm.Assign_var(sym_name, value)
+}
+func (vm *IcebergVM) inst_peek(args []Entity) {
+	depth := len(vm.value_stack)
+	if depth == 0 {
+		vm.Runtime_error("VM ERROR: peek on empty stack")
+	}
+	value, _ := vm.Get_argument(vm.value_stack[depth-1], T_ANY)
+	sym_name := vm.Get_baresymbol(args[0])
+	vm.Assign_var(sym_name, value)
+}
+func (vm *IcebergVM) inst_depth(args []Entity) {
+	sym_name := vm.Get_baresymbol(args[0])
+	vm.Assign_var(sym_name, int64(len(vm.value_stack)))
+}
+func (vm *IcebergVM) chk_safe(inst_name string) {
+	if vm.SafeMode {
+		vm.Runtime_error(fmt.Sprintf("System ERROR: %s is not allowed in safe mode", inst_name))
+	}
+}
+func (vm *IcebergVM) inst_getenv(args []Entity) {
+	vm.chk_safe("getenv")
+	operand, _ := vm.Get_argument(args[0], T_STR)
+
+	lookup_env := vm.Environ
+	if lookup_env == nil {
+		lookup_env = os.LookupEnv
+	}
+	value, found := lookup_env(operand.(string))
+	vm.Assign_var(vm.Get_baresymbol(args[1]), value)
+	vm.Assign_var(vm.Get_baresymbol(args[2]), found)
+}
+
+func (vm *IcebergVM) filesystem() FileSystem {
+	if vm.FS == nil {
+		return os_fs{}
+	}
+	return vm.FS
+}
+func (vm *IcebergVM) inst_readfile(args []Entity) {
+	vm.chk_safe("readfile")
+	path, _ := vm.Get_argument(args[0], T_STR)
+
+	file, err := vm.filesystem().Open(path.(string))
+	if err != nil {
+		vm.Runtime_error(fmt.Sprintf("System ERROR: readfile failed. err: %s", err.Error()))
+	}
+	defer file.Close()
+	content, err := io.ReadAll(file)
+	if err != nil {
+		vm.Runtime_error(fmt.Sprintf("System ERROR: readfile failed. err: %s", err.Error()))
+	}
+	sym_name := vm.Get_baresymbol(args[1])
+	vm.Assign_var(sym_name, string(content))
+}
+func (vm *IcebergVM) inst_writefile(args []Entity) {
+	vm.chk_safe("writefile")
+	path, _ := vm.Get_argument(args[0], T_STR)
+	content, _ := vm.Get_argument(args[1], T_STR)
+
+	file, err := vm.filesystem().Create(path.(string))
+	if err != nil {
+		vm.Runtime_error(fmt.Sprintf("System ERROR: writefile failed. err: %s", err.Error()))
+	}
+	_, err = io.WriteString(file, content.(string))
+	close_err := file.Close()
+	if err == nil {
+		err = close_err
+	}
+	if err != nil {
+		vm.Runtime_error(fmt.Sprintf("System ERROR: writefile failed. err: %s", err.Error()))
+	}
+}
+
+func (vm *IcebergVM) inst_version(args []Entity) {
+	sym_name := vm.Get_baresymbol(args[0])
+	vm.Assign_var(sym_name, Version)
 }
 
 func (vm *IcebergVM) inst_dump(args []Entity) {
-	fmt.Println("Dump begin ---")
-	fmt.Println("Variable Symbol Table:")
-	for key, value := range vm.var_table {
-		cnv, c_type := vm.Get_argument(value, T_ANY)
-		fmt.Printf("%s -> %v <type: %d>\n", key, cnv, c_type)
+	io.WriteString(vm.stdout(), vm.DumpString())
+}
+
+// The variables of the current scope in sorted order, as printed by dump
+func (vm *IcebergVM) DumpString() string {
+	keys := make([]string, 0, len(vm.var_table))
+	for key := range vm.var_table {
+		keys = append(keys, key)
 	}
-	fmt.Println("Dump end---")
+	sort.Strings(keys)
+
+	var out strings.Builder
+	fmt.Fprintln(&out, "Dump begin ---")
+	fmt.Fprintln(&out, "Variable Symbol Table:")
+	for _, key := range keys {
+		value := vm.var_table[key]
+		cnv, _ := decode_entity(value)
+		if value.E_type == T_NIL {
+			cnv = "nil"
+		}
+		fmt.Fprintf(&out, "%s -> %v <type: %d>\n", key, cnv, value.E_type)
+	}
+	fmt.Fprintln(&out, "Dump end---")
+	return out.String()
+}
+
+func (vm *IcebergVM) stdout() io.Writer {
+	if vm.Stdout == nil {
+		return os.Stdout
+	}
+	return vm.Stdout
+}
+func (vm *IcebergVM) inst_print(args []Entity) {
+	pieces := make([]string, len(args))
+	for i, arg := range args {
+		operand, type_o := vm.Get_argument(arg, T_ANY ^ T_LABEL)
+		pieces[i] = vm.stringify(operand, type_o)
+	}
+	fmt.Fprintln(vm.stdout(), strings.Join(pieces, " "))
 }
 
-//func (vm *IcebergVM) inst_print(args []Entity) {
-//	operand, _ := vm.Get_argument(args[0], T_STR)
-//	fmt.Println(operand.(string))
-//}
+// Clears variables, stacks and program state so the VM can run a fresh program.
+// Inst_table, including custom instructions, and the configuration fields are kept.
+func (vm *IcebergVM) Reset() {
+	vm.chk_copy()
+	vm.exec_pos = 0
+	vm.jumped = false
+	vm.inst_list = nil
+	vm.label_table = make(map[string]int64)
+	vm.var_table = make(map[string]Entity)
+	vm.scope_stack = make([]map[string]Entity, 0)
+	vm.value_stack = make([]Entity, 0)
+	vm.try_stack = make([]try_handler, 0)
+	vm.eval_list = nil
+	vm.eval_labels = nil
+	vm.mem_used = 0
+	vm.exit_code = 0
+}
 
 func (vm *IcebergVM) Init() {
+	vm.self = vm
 	vm.Inst_table = make(map[string]InstructionDesc)
+	vm.bound_insts = make(map[string]bound_inst)
 	vm.label_table = make(map[string]int64)
 	vm.var_table = make(map[string]Entity)
+	vm.scope_stack = make([]map[string]Entity, 0)
+	vm.value_stack = make([]Entity, 0)
+	vm.try_stack = make([]try_handler, 0)
+	vm.mem_used = 0
+	vm.CommentPrefix = "#"
 	
-	vm.Inst_table["nop"] = InstructionDesc{ vm.inst_nop, 0, }
-	vm.Inst_table["let"] = InstructionDesc{ vm.inst_let, 2, }
-	vm.Inst_table["add"] = InstructionDesc{ vm.inst_add, 3, }
-	vm.Inst_table["sub"] = InstructionDesc{ vm.inst_sub, 3, }
-	vm.Inst_table["mul"] = InstructionDesc{ vm.inst_mul, 3, }
-	vm.Inst_table["div"] = InstructionDesc{ vm.inst_div, 3, }
-	vm.Inst_table["div_r"] = InstructionDesc{ vm.inst_div_r, 3, }
-	vm.Inst_table["mod"] = InstructionDesc{ vm.inst_mod, 3, }
-	vm.Inst_table["pow"] = InstructionDesc{ vm.inst_pow, 3, }
-	vm.Inst_table["cmp"] = InstructionDesc{ vm.inst_cmp, 4, }
-	vm.Inst_table["and"] = InstructionDesc{ vm.inst_and, 3, }
-	vm.Inst_table["or"] = InstructionDesc{ vm.inst_or, 3, }
-	vm.Inst_table["xor"] = InstructionDesc{ vm.inst_xor, 3, }
-	vm.Inst_table["not"] = InstructionDesc{ vm.inst_not, 2, }
-	vm.Inst_table["int"] = InstructionDesc{ vm.inst_int, 2, }
-	vm.Inst_table["float"] = InstructionDesc{ vm.inst_float, 2, }
-	vm.Inst_table["bool"] = InstructionDesc{ vm.inst_bool, 2, }
-	vm.Inst_table["str"] = InstructionDesc{ vm.inst_str, 2, }
-	vm.Inst_table["cat"] = InstructionDesc{ vm.inst_cat, 3, }
-	vm.Inst_table["goto"] = InstructionDesc{ vm.inst_goto, 1, }
-	vm.Inst_table["when"] = InstructionDesc{ vm.inst_when, 2, }
-
-	vm.Inst_table["dump"] = InstructionDesc{ vm.inst_dump, 0, }
-	
-	//vm.Inst_table["print"] = InstructionDesc{ vm.inst_print, 1, }
+	vm.Inst_table["nop"] = InstructionDesc{ vm.inst_nop, 0, 0, "nop; does nothing", }
+	vm.Inst_table["note"] = InstructionDesc{ vm.inst_note, 1, 0, "note text; does nothing, annotates the bytecode", }
+	vm.Inst_table["let"] = InstructionDesc{ vm.inst_let, 2, 0, "let dest, value; assigns value to dest", }
+	vm.Inst_table["add"] = InstructionDesc{ vm.inst_add, 3, 0, "add a, b, dest; dest = a + b", }
+	vm.Inst_table["sub"] = InstructionDesc{ vm.inst_sub, 3, 0, "sub a, b, dest; dest = a - b", }
+	vm.Inst_table["mul"] = InstructionDesc{ vm.inst_mul, 3, 0, "mul a, b, dest; dest = a * b", }
+	vm.Inst_table["div"] = InstructionDesc{ vm.inst_div, 3, 0, "div a, b, dest; dest = a / b rounded down", }
+	vm.Inst_table["div_r"] = InstructionDesc{ vm.inst_div_r, 3, 0, "div_r a, b, dest; dest = a / b as a float", }
+	vm.Inst_table["mod"] = InstructionDesc{ vm.inst_mod, 3, 0, "mod a, b, dest; dest = a mod b", }
+	vm.Inst_table["pow"] = InstructionDesc{ vm.inst_pow, 3, 0, "pow a, b, dest; dest = a to the power b", }
+	vm.Inst_table["hypot"] = InstructionDesc{ vm.inst_hypot, 3, 0, "hypot a, b, dest; dest = sqrt(a*a + b*b)", }
+	vm.Inst_table["powmod"] = InstructionDesc{ vm.inst_powmod, 4, 0, "powmod a, e, m, dest; dest = a to the power e mod m", }
+	vm.Inst_table["gcd"] = InstructionDesc{ vm.inst_gcd, 3, 0, "gcd a, b, dest; greatest common divisor", }
+	vm.Inst_table["lcm"] = InstructionDesc{ vm.inst_lcm, 3, 0, "lcm a, b, dest; least common multiple", }
+	vm.Inst_table["sign"] = InstructionDesc{ vm.inst_sign, 2, 0, "sign a, dest; dest = -1, 0 or 1", }
+	vm.Inst_table["isnan"] = InstructionDesc{ vm.inst_isnan, 2, 0, "isnan a, dest; true if a is NaN", }
+	vm.Inst_table["isinf"] = InstructionDesc{ vm.inst_isinf, 2, 0, "isinf a, dest; true if a is infinite", }
+	vm.Inst_table["cmp"] = InstructionDesc{ vm.inst_cmp, 4, 0, "cmp a, op, b, dest; compares a and b with op (==, !=, <, <=, >, >=)", }
+	vm.Inst_table["and"] = InstructionDesc{ vm.inst_and, 3, 0, "and a, b, dest; logical and", }
+	vm.Inst_table["or"] = InstructionDesc{ vm.inst_or, 3, 0, "or a, b, dest; logical or", }
+	vm.Inst_table["xor"] = InstructionDesc{ vm.inst_xor, 3, 0, "xor a, b, dest; logical exclusive or", }
+	vm.Inst_table["not"] = InstructionDesc{ vm.inst_not, 2, 0, "not a, dest; logical not", }
+	vm.Inst_table["int"] = InstructionDesc{ vm.inst_int, 2, 0, "int dest, value; converts value to int", }
+	vm.Inst_table["float"] = InstructionDesc{ vm.inst_float, 2, 0, "float dest, value; converts value to float", }
+	vm.Inst_table["bool"] = InstructionDesc{ vm.inst_bool, 2, 0, "bool dest, value; converts value to bool", }
+	vm.Inst_table["str"] = InstructionDesc{ vm.inst_str, 2, 0, "str dest, value; converts value to str", }
+	vm.Inst_table["fmtfloat"] = InstructionDesc{ vm.inst_fmtfloat, 3, 0, "fmtfloat value, precision, dest; fixed-point formatting", }
+	vm.Inst_table["boolstr"] = InstructionDesc{ vm.inst_boolstr, 2, 0, "boolstr value, dest; \"1\" or \"0\"", }
+	vm.Inst_table["reprfloat"] = InstructionDesc{ vm.inst_reprfloat, 2, 0, "reprfloat value, dest; compact float formatting", }
+	vm.Inst_table["fmtint"] = InstructionDesc{ vm.inst_fmtint, 3, 0, "fmtint value, base, dest; formats in base 2 to 36", }
+	vm.Inst_table["hash"] = InstructionDesc{ vm.inst_hash, 2, 0, "hash str, dest; 64-bit FNV-1a hash as int", }
+	vm.Inst_table["hashstr"] = InstructionDesc{ vm.inst_hashstr, 2, 0, "hashstr str, dest; 64-bit FNV-1a hash as hex", }
+	vm.Inst_table["parseintbase"] = InstructionDesc{ vm.inst_parseintbase, 4, 0, "parseintbase str, base, dest, ok; parses an int in base 2 to 36, or 0 for a prefix", }
+	vm.Inst_table["hexencode"] = InstructionDesc{ vm.inst_hexencode, 2, 0, "hexencode str, dest; encodes the bytes of str as hex", }
+	vm.Inst_table["hexdecode"] = InstructionDesc{ vm.inst_hexdecode, 2, 0, "hexdecode str, dest; decodes hex into a string", }
+	vm.Inst_table["match"] = InstructionDesc{ vm.inst_match, 3, 0, "match pattern, str, dest; true if the regex matches str", }
+	vm.Inst_table["capture"] = InstructionDesc{ vm.inst_capture, 4, 0, "capture pattern, str, group, dest; a regex group, or \"\" without a match", }
+	vm.Inst_table["regexreplace"] = InstructionDesc{ vm.inst_regexreplace, 4, 0, "regexreplace pattern, str, template, dest; replaces every regex match", }
+	vm.Inst_table["cat"] = InstructionDesc{ vm.inst_cat, 3, 0, "cat a, b, dest; concatenates two strings", }
+	vm.Inst_table["select"] = InstructionDesc{ vm.inst_select, 4, 0, "select cond, then, else, dest; picks then or else by cond", }
+	vm.Inst_table["isnil"] = InstructionDesc{ vm.inst_isnil, 2, 0, "isnil value, dest; true if value is nil", }
+	vm.Inst_table["deepequal"] = InstructionDesc{ vm.inst_deepequal, 3, 0, "deepequal a, b, dest; true if a and b have the same type and value", }
+	vm.Inst_table["bytelen"] = InstructionDesc{ vm.inst_bytelen, 2, 0, "bytelen str, dest; length in bytes", }
+	vm.Inst_table["charat"] = InstructionDesc{ vm.inst_charat, 3, 0, "charat str, index, dest; the character at index", }
+	vm.Inst_table["padleft"] = InstructionDesc{ vm.inst_padleft, 3, 4, "padleft str, width, [pad,] dest; pads on the left to width characters", }
+	vm.Inst_table["padright"] = InstructionDesc{ vm.inst_padright, 3, 4, "padright str, width, [pad,] dest; pads on the right to width characters", }
+	vm.Inst_table["goto"] = InstructionDesc{ vm.inst_goto, 1, 0, "goto @label; jumps to label", }
+	vm.Inst_table["exit"] = InstructionDesc{ vm.inst_exit, 0, 1, "exit [code]; stops the program with an exit code", }
+	vm.Inst_table["when"] = InstructionDesc{ vm.inst_when, 2, 0, "when cond, @label; jumps to label if cond is true", }
+	vm.Inst_table["jump"] = InstructionDesc{ vm.inst_jump, 1, 0, "jump name; jumps to the label named by a string", }
+	vm.Inst_table["labeladdr"] = InstructionDesc{ vm.inst_labeladdr, 2, 0, "labeladdr @label, dest; the instruction index of label", }
+	vm.Inst_table["gotoidx"] = InstructionDesc{ vm.inst_gotoidx, 1, 0, "gotoidx index; jumps to an instruction index", }
+	vm.Inst_table["here"] = InstructionDesc{ vm.inst_here, 1, 0, "here dest; the index of this instruction", }
+	vm.Inst_table["jmprel"] = InstructionDesc{ vm.inst_jmprel, 1, 0, "jmprel offset; jumps offset instructions from this one", }
+	vm.Inst_table["try"] = InstructionDesc{ vm.inst_try, 2, 0, "try @label, err; on a runtime error, jumps to label with the message in err", }
+	vm.Inst_table["endtry"] = InstructionDesc{ vm.inst_endtry, 0, 0, "endtry; ends the innermost try", }
+	vm.Inst_table["pushscope"] = InstructionDesc{ vm.inst_pushscope, 0, 0, "pushscope; starts a new variable scope", }
+	vm.Inst_table["popscope"] = InstructionDesc{ vm.inst_popscope, 0, 0, "popscope; drops the innermost variable scope", }
+	vm.Inst_table["push"] = InstructionDesc{ vm.inst_push, 1, 0, "push value; pushes value onto the stack", }
+	vm.Inst_table["pop"] = InstructionDesc{ vm.inst_pop, 1, 0, "pop dest; pops the stack into dest", }
+	vm.Inst_table["peek"] = InstructionDesc{ vm.inst_peek, 1, 0, "peek dest; copies the top of the stack into dest", }
+	vm.Inst_table["depth"] = InstructionDesc{ vm.inst_depth, 1, 0, "depth dest; number of values on the stack", }
+	vm.Inst_table["getenv"] = InstructionDesc{ vm.inst_getenv, 3, 0, "getenv name, dest, found; reads an environment variable", }
+	vm.Inst_table["readfile"] = InstructionDesc{ vm.inst_readfile, 2, 0, "readfile path, dest; reads a whole file", }
+	vm.Inst_table["writefile"] = InstructionDesc{ vm.inst_writefile, 2, 0, "writefile path, str; writes str to a file", }
+
+	vm.Inst_table["version"] = InstructionDesc{ vm.inst_version, 1, 0, "version dest; the VM version", }
+	vm.Inst_table["dump"] = InstructionDesc{ vm.inst_dump, 0, 0, "dump; prints the variables of the current scope", }
+	vm.Inst_table["print"] = InstructionDesc{ vm.inst_print, 0, N_UNLIMITED, "print [value, ...]; prints values separated by spaces", }
+
+	for name, desc := range vm.Inst_table {
+		vm.bound_insts[name] = bound_inst{ desc.Function, nil, }
+	}
+}
+
+// Adds or replaces the instruction name. The argument count is checked when a
+// script is compiled, so the function always receives exactly desc.N_args
+// entities, or between N_args and Max_args for a variadic instruction.
+// Register before compiling code that uses the instruction.
+func (vm *IcebergVM) RegisterInstruction(name string, desc InstructionDesc) error {
+	err := chk_instruction(name, desc)
+	if err != nil {
+		return err
+	}
+	vm.Inst_table[name] = desc
+	return nil
+}
+
+// Like RegisterInstruction, but f receives the VM running the instruction, so
+// Clone can bind the instruction to the clone instead of to this VM.
+func (vm *IcebergVM) RegisterVMInstruction(name string, f func(*IcebergVM, []Entity), n_args int64, max_args int64, doc string) error {
+	desc := InstructionDesc{ nil, n_args, max_args, doc, }
+	if f != nil {
+		desc.Function = vm.bind_inst(f)
+	}
+	err := chk_instruction(name, desc)
+	if err != nil {
+		return err
+	}
+	vm.Inst_table[name] = desc
+	vm.bound_insts[name] = bound_inst{ desc.Function, f, }
+	return nil
+}
+
+// A function bound to a VM: a built-in when f is nil, otherwise f from RegisterVMInstruction
+type bound_inst struct {
+	function func([]Entity)
+	f func(*IcebergVM, []Entity)
+}
+
+// Whether a and b are the same function value. reflect only exposes the code pointer,
+// which every closure from one function literal shares whatever it captured.
+func same_func(a func([]Entity), b func([]Entity)) bool {
+	return *(*unsafe.Pointer)(unsafe.Pointer(&a)) == *(*unsafe.Pointer)(unsafe.Pointer(&b))
+}
+func (vm *IcebergVM) bind_inst(f func(*IcebergVM, []Entity)) func([]Entity) {
+	return func(args []Entity) {
+		f(vm, args)
+	}
+}
+
+// Registers every instruction in insts, or none of them if any is invalid or
+// would replace a built-in instruction
+func (vm *IcebergVM) RegisterInstructions(insts map[string]InstructionDesc) error {
+	names := make([]string, 0, len(insts))
+	for name := range insts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	builtins := &IcebergVM{}
+	builtins.Init()
+	for _, name := range names {
+		err := chk_instruction(name, insts[name])
+		if err != nil {
+			return err
+		}
+		_, exist := builtins.Inst_table[name]
+		if exist {
+			return new_host_error(fmt.Sprintf("Argument ERROR: %s is a built-in instruction", name))
+		}
+	}
+	for _, name := range names {
+		vm.Inst_table[name] = insts[name]
+	}
+	return nil
+}
+
+func chk_instruction(name string, desc InstructionDesc) error {
+	if name == "" || strings.IndexFunc(name, is_blank) != -1 || strings.IndexRune(name, '@') == 0 {
+		return new_host_error(fmt.Sprintf("Argument ERROR: Invalid instruction name %q", name))
+	}
+	if desc.Function == nil {
+		return new_host_error(fmt.Sprintf("Argument ERROR: Instruction %s has no function", name))
+	}
+	if desc.N_args < 0 {
+		return new_host_error(fmt.Sprintf("Argument ERROR: Instruction %s has negative arity %d", name, desc.N_args))
+	}
+	if desc.Max_args != 0 && desc.Max_args != N_UNLIMITED && desc.Max_args < desc.N_args {
+		return new_host_error(fmt.Sprintf("Argument ERROR: Instruction %s takes at most %d args but at least %d", name, desc.Max_args, desc.N_args))
+	}
+	return nil
+}
+
+// The Doc of instruction name, or false if there is no such instruction
+func (vm *IcebergVM) Help(name string) (string, bool) {
+	desc, exist := vm.Inst_table[name]
+	if !exist {
+		return "", false
+	}
+	return desc.Doc, true
+}
+
+// Sorted names of every registered instruction, custom ones included
+func (vm *IcebergVM) InstructionNames() []string {
+	names := make([]string, 0, len(vm.Inst_table))
+	for name := range vm.Inst_table {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// For variadic instructions this is the least number of arguments
+func (vm *IcebergVM) InstructionArity(name string) (int64, bool) {
+	desc, exist := vm.Inst_table[name]
+	if !exist {
+		return 0, false
+	}
+	return desc.N_args, true
+}
+
+// Returns an independent VM with the same instructions, configuration and variables.
+// A built-in or RegisterVMInstruction function still registered under its own name
+// is rebound to the clone; any other function is copied as it is, so it still acts
+// on whatever it was bound to. N_args, Max_args and Doc are always copied.
+func (vm *IcebergVM) Clone() *IcebergVM {
+	clone := &IcebergVM{}
+	clone.Init()
+	clone.StrictFloat = vm.StrictFloat
+	clone.SafeMode = vm.SafeMode
+	clone.CommentPrefix = vm.CommentPrefix
+	clone.CaseInsensitive = vm.CaseInsensitive
+	clone.MaxStringLen = vm.MaxStringLen
+	clone.MaxMemoryBytes = vm.MaxMemoryBytes
+	clone.Environ = vm.Environ
+	clone.FS = vm.FS
+	clone.Stdout = vm.Stdout
+
+	builtins := clone.Inst_table
+	clone.Inst_table = make(map[string]InstructionDesc, len(vm.Inst_table))
+	clone.bound_insts = make(map[string]bound_inst)
+	for name, desc := range vm.Inst_table {
+		bound, exist := vm.bound_insts[name]
+		if exist && same_func(desc.Function, bound.function) {
+			if bound.f == nil {
+				desc.Function = builtins[name].Function
+			} else {
+				desc.Function = clone.bind_inst(bound.f)
+			}
+			clone.bound_insts[name] = bound_inst{ desc.Function, bound.f, }
+		}
+		clone.Inst_table[name] = desc
+	}
+
+	clone.var_table = copy_scope(vm.var_table)
+	for _, scope := range vm.scope_stack {
+		clone.scope_stack = append(clone.scope_stack, copy_scope(scope))
+	}
+	for _, value := range vm.value_stack {
+		clone.value_stack = append(clone.value_stack, copy_entity(value))
+	}
+	clone.mem_used = vm.mem_used
+	return clone
+}
+func copy_scope(scope map[string]Entity) map[string]Entity {
+	new_scope := make(map[string]Entity, len(scope))
+	for key, value := range scope {
+		new_scope[key] = copy_entity(value)
+	}
+	return new_scope
+}
+func copy_entity(value Entity) Entity {
+	data := make([]byte, len(value.Data))
+	copy(data, value.Data)
+	return Entity{
+		data,
+		value.E_type,
+	}
 }
@@ -0,0 +1,2017 @@
+package iceberg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Expected value of a variable that must not be bound after the run
+var unbound = &struct{}{}
+
+type script_case struct {
+	name string
+	script string
+	// Variables to check after the run
+	want map[string]interface{}
+	// Substring of the expected error; "" expects success
+	want_err string
+}
+
+func new_test_vm() (*IcebergVM, *bytes.Buffer) {
+	vm := &IcebergVM{}
+	vm.Init()
+	out := new(bytes.Buffer)
+	vm.Stdout = out
+	return vm, out
+}
+
+// Compiles and runs script on vm, returning what it printed
+func run_on(vm *IcebergVM, out *bytes.Buffer, script string) (string, error) {
+	code, err := vm.Compile(script)
+	if err != nil {
+		return out.String(), err
+	}
+	err = vm.Run(code)
+	return out.String(), err
+}
+
+func run_script(script string) (*IcebergVM, string, error) {
+	vm, out := new_test_vm()
+	output, err := run_on(vm, out, script)
+	return vm, output, err
+}
+
+func chk_result(t *testing.T, err error, want_err string) bool {
+	t.Helper()
+	if want_err == "" {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return true
+	}
+	if err == nil {
+		t.Fatalf("expected an error containing %q, got none", want_err)
+	}
+	if !strings.Contains(err.Error(), want_err) {
+		t.Fatalf("expected an error containing %q, got %v", want_err, err)
+	}
+	return false
+}
+
+func chk_vars(t *testing.T, vm *IcebergVM, want map[string]interface{}) {
+	t.Helper()
+	for symbol, want_value := range want {
+		got, exist := vm.GetVar(symbol)
+		if want_value == unbound {
+			if exist {
+				t.Errorf("%s: expected unbound, got %#v", symbol, got)
+			}
+			continue
+		}
+		if !exist {
+			t.Errorf("%s: unbound, expected %#v", symbol, want_value)
+		} else if got != want_value {
+			t.Errorf("%s: got %#v, expected %#v", symbol, got, want_value)
+		}
+	}
+}
+
+func run_cases(t *testing.T, cases []script_case) {
+	t.Helper()
+	run_cases_with(t, nil, cases)
+}
+
+// Like run_cases, but setup configures each VM before its script is compiled
+func run_cases_with(t *testing.T, setup func(vm *IcebergVM), cases []script_case) {
+	t.Helper()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vm, out := new_test_vm()
+			if setup != nil {
+				setup(vm)
+			}
+			_, err := run_on(vm, out, c.script)
+			if chk_result(t, err, c.want_err) {
+				chk_vars(t, vm, c.want)
+			}
+		})
+	}
+}
+
+func TestScopes(t *testing.T) {
+	run_cases(t, []script_case{
+		{"inner shadows outer", "let x, 1\npushscope\nlet x, 2\nlet y, x\npopscope", map[string]interface{}{"x": int64(1), "y": unbound}, ""},
+		{"outer visible inside", "let x, 1\npushscope\nadd x, 1, y\npopscope\nlet z, 0", map[string]interface{}{"x": int64(1), "y": unbound}, ""},
+		{"locals dropped", "pushscope\nlet x, 1\npopscope\nlet y, x", nil, "Unbound symbol x"},
+		{"nested", "let a, 1\npushscope\npushscope\nadd a, 1, b\npopscope\nlet c, 3\npopscope", map[string]interface{}{"a": int64(1), "b": unbound, "c": unbound}, ""},
+		{"unbalanced popscope", "popscope", nil, "popscope without matching pushscope"},
+	})
+}
+
+const factorial_script = `push 5
+labeladdr @back, ret
+push ret
+goto @fact
+@back
+pop result
+exit
+
+# fact n; pushes n!, returning to the address pushed after n
+@fact
+pop ret_addr
+pop n
+let acc, 1
+@f_loop
+cmp n, "<=", 1, done
+when done, @f_done
+mul acc, n, acc
+sub n, 1, n
+goto @f_loop
+@f_done
+push acc
+gotoidx ret_addr`
+
+func TestValueStack(t *testing.T) {
+	run_cases(t, []script_case{
+		{"lifo", "push 1\npush \"two\"\npop a\npop b", map[string]interface{}{"a": "two", "b": int64(1)}, ""},
+		{"factorial subroutine", factorial_script, map[string]interface{}{"result": int64(120), "ret_addr": int64(4)}, ""},
+		{"pop empty", "pop a", nil, "VM ERROR"},
+		{"pop into other type", "let a, 1\npush \"s\"\npop a", nil, "Type mismatch"},
+	})
+}
+
+func TestPeekDepth(t *testing.T) {
+	run_cases(t, []script_case{
+		{"peek keeps the value", "push 7\npeek a\ndepth d", map[string]interface{}{"a": int64(7), "d": int64(1)}, ""},
+		{"depth counts", "depth d0\npush 1\npush 2\ndepth d2\npop x\ndepth d1", map[string]interface{}{"d0": int64(0), "d1": int64(1), "d2": int64(2)}, ""},
+		{"peek empty", "peek a", nil, "VM ERROR"},
+	})
+}
+
+func TestTry(t *testing.T) {
+	run_cases(t, []script_case{
+		{"div by zero recovered", "try @caught, e\ndiv 1, 0, x\nlet reached, true\n@caught\nlet after, 1", map[string]interface{}{"x": unbound, "reached": unbound, "after": int64(1)}, ""},
+		{"message in err", "try @caught, e\ndiv 1, 0, x\n@caught\nmatch \"Math ERROR\", e, is_math", map[string]interface{}{"is_math": true}, ""},
+		{"no error skips handler", "try @caught, e\nlet x, 1\nendtry\ngoto @end\n@caught\nlet handled, true\n@end", map[string]interface{}{"x": int64(1), "handled": unbound, "e": unbound}, ""},
+		{"endtry disarms", "try @caught, e\nendtry\ndiv 1, 0, x\n@caught", nil, "Math ERROR"},
+		{"scopes unwound", "try @caught, e\npushscope\nlet local, 1\ndiv 1, 0, x\n@caught\nlet outer, local", nil, "Unbound symbol local"},
+		{"nested innermost first", "try @outer, e1\ntry @inner, e2\ndiv 1, 0, x\n@inner\ndiv 1, 0, y\n@outer\nlet done, true", map[string]interface{}{"done": true}, ""},
+		{"unset label", "try @nowhere, e", nil, "Unset label @nowhere"},
+		{"endtry without try", "endtry", nil, "endtry without matching try"},
+	})
+}
+
+func TestTryClearedBetweenRuns(t *testing.T) {
+	vm, out := new_test_vm()
+	// Leaves its handler armed when the program ends
+	_, err := run_on(vm, out, "try @caught, e\nlet x, 1\n@caught")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A stale handler would jump to this program's @caught
+	_, err = run_on(vm, out, "div 1, 0, x\n@caught\nlet handled, true")
+	chk_result(t, err, "Math ERROR")
+}
+
+func TestErrorKind(t *testing.T) {
+	cases := []struct {
+		script string
+		kind ErrorKind
+		pos int64
+		compile_time bool
+	}{
+		{"let x, 1\nadd x, y, z", ERR_ARGUMENT, 1, false},
+		{"let x, 1\nlet x, \"s\"", ERR_TYPE, 1, false},
+		{"nop\nnop\ndiv 1, 0, x", ERR_MATH, 2, false},
+		{"popscope", ERR_VM, 0, false},
+		{"nop\nadd 1, 2", ERR_SYNTAX, 2, true},
+		{"frobnicate 1", ERR_SYNTAX, 1, true},
+	}
+	for _, c := range cases {
+		_, _, err := run_script(c.script)
+		var ice_err *IcebergError
+		if !errors.As(err, &ice_err) {
+			t.Fatalf("%q: expected *IcebergError, got %#v", c.script, err)
+		}
+		if ice_err.Kind != c.kind || ice_err.Pos != c.pos || ice_err.Compile_time != c.compile_time {
+			t.Errorf("%q: got kind %d pos %d compile_time %v, expected %d %d %v", c.script, ice_err.Kind, ice_err.Pos, ice_err.Compile_time, c.kind, c.pos, c.compile_time)
+		}
+	}
+}
+
+func TestToGo(t *testing.T) {
+	vm, _ := new_test_vm()
+	vm.SetVar("x", "bound")
+	cases := []struct {
+		literal string
+		want interface{}
+	}{
+		{"42", int64(42)},
+		{"-1.5", float64(-1.5)},
+		{"true", true},
+		{"\"text\"", "text"},
+		{"@label", "@label"},
+		{"nil", nil},
+		{"x", "bound"},
+	}
+	for _, c := range cases {
+		got, err := vm.ToGo(vm.conv_arg([]byte(c.literal)))
+		if err != nil || got != c.want {
+			t.Errorf("%s: got %#v, %v, expected %#v", c.literal, got, err, c.want)
+		}
+	}
+
+	_, err := vm.ToGo(vm.conv_arg([]byte("missing")))
+	chk_result(t, err, "Unbound symbol missing")
+	_, err = vm.ToGo(Entity{[]byte{1, 2}, T_INT})
+	chk_result(t, err, "System ERROR")
+}
+
+type named_int int16
+
+func TestSetVarGetVar(t *testing.T) {
+	cases := []struct {
+		value interface{}
+		want interface{}
+	}{
+		{int(3), int64(3)},
+		{int8(-4), int64(-4)},
+		{int32(5), int64(5)},
+		{uint(6), int64(6)},
+		{uint8(7), int64(7)},
+		{named_int(8), int64(8)},
+		{float32(1.5), float64(1.5)},
+		{2.25, float64(2.25)},
+		{true, true},
+		{"s", "s"},
+		{nil, nil},
+	}
+	for _, c := range cases {
+		vm, _ := new_test_vm()
+		err := vm.SetVar("v", c.value)
+		if err != nil {
+			t.Errorf("%T: %v", c.value, err)
+			continue
+		}
+		got, exist := vm.GetVar("v")
+		if !exist || got != c.want {
+			t.Errorf("%T %v: got %#v, expected %#v", c.value, c.value, got, c.want)
+		}
+	}
+
+	vm, out := new_test_vm()
+	vm.SetVar("n", 20)
+	_, err := run_on(vm, out, "add n, 1, n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chk_vars(t, vm, map[string]interface{}{"n": int64(21)})
+
+	errs := []struct {
+		symbol string
+		value interface{}
+		want string
+	}{
+		{"u", uint64(1 << 63), "Math ERROR: 9223372036854775808 overflows int"},
+		{"u", []int{1}, "Type ERROR: Go type []int is not compatible with Iceberg"},
+		{"n", "str", "Type ERROR: Type mismatch, n holds int but got str"},
+		{"12", 1, "Type ERROR: Invalid symbol name 12"},
+	}
+	for _, c := range errs {
+		err := vm.SetVar(c.symbol, c.value)
+		// Host calls have no instruction to point at
+		if err == nil || err.Error() != c.want {
+			t.Errorf("SetVar(%q, %#v): got %v, expected %q", c.symbol, c.value, err, c.want)
+		}
+	}
+	_, exist := vm.GetVar("missing")
+	if exist {
+		t.Error("GetVar found an unbound symbol")
+	}
+}
+
+func TestVars(t *testing.T) {
+	vm, out := new_test_vm()
+	_, err := run_on(vm, out, "let a, 1\nlet b, \"outer\"\npushscope\nlet b, 2.5\nlet c, true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"a": int64(1), "b": 2.5, "c": true}
+	vars := vm.Vars()
+	if len(vars) != len(want) {
+		t.Fatalf("got %v, expected %v", vars, want)
+	}
+	for key, value := range want {
+		if vars[key] != value {
+			t.Errorf("%s: got %#v, expected %#v", key, vars[key], value)
+		}
+	}
+	// A snapshot, not a view
+	vars["a"] = int64(100)
+	chk_vars(t, vm, map[string]interface{}{"a": int64(1)})
+}
+
+func TestCompile(t *testing.T) {
+	vm, out := new_test_vm()
+	_, err := vm.Compile("let x, 1\nprint x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 || len(vm.Vars()) != 0 {
+		t.Errorf("Compile ran the program: printed %q, vars %v", out.String(), vm.Vars())
+	}
+
+	cases := []struct {
+		script string
+		want string
+	}{
+		{"print 1\nbogus 1", "In line 2,\nSyntax ERROR"},
+		{"add 1, 2", "Too few arguments(3 expected but 2 given)"},
+		{"nop 1", "Too many arguments"},
+	}
+	for _, c := range cases {
+		_, err := vm.Compile(c.script)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%q: got %v, expected %q", c.script, err, c.want)
+		}
+	}
+	if out.Len() != 0 {
+		t.Errorf("a failed Compile printed %q", out.String())
+	}
+
+	defer func() {
+		_, ok := recover().(*IcebergError)
+		if !ok {
+			t.Error("Gen_bytecode did not panic with *IcebergError")
+		}
+	}()
+	vm.Gen_bytecode("bogus")
+}
+
+func TestMultilineString(t *testing.T) {
+	run_cases(t, []script_case{
+		{"two lines", "let s, \"first\nsecond\"\nlet after, 1", map[string]interface{}{"s": "first\nsecond", "after": int64(1)}, ""},
+		{"keeps indentation", "let s, 'a\n    b'", map[string]interface{}{"s": "a\n    b"}, ""},
+		{"other quote inside", "let s, \"it's\nfine\"", map[string]interface{}{"s": "it's\nfine"}, ""},
+		{"commas inside", "cat \"a, b\n\", \"c\", s", map[string]interface{}{"s": "a, b\nc"}, ""},
+	})
+	// Later lines are numbered from their own line, not the literal's first
+	_, _, err := run_script("let s, \"x\ny\"\nbogus")
+	chk_result(t, err, "In line 3,")
+}
+
+func TestWhitespace(t *testing.T) {
+	run_cases(t, []script_case{
+		{"tab separated", "let\tx,\t1", map[string]interface{}{"x": int64(1)}, ""},
+		{"indented", "\t  let x, 1\n    add x, 1, x", map[string]interface{}{"x": int64(2)}, ""},
+		{"trailing blanks", "let x, 1  \t\nnop \t", map[string]interface{}{"x": int64(1)}, ""},
+		{"crlf", "let x, 1\r\nadd x, 2, x\r\n", map[string]interface{}{"x": int64(3)}, ""},
+		{"indented label", "let x, 0\n  @l\n  add x, 1, x\n  cmp x, \"<\", 3, c\n  when c, @l", map[string]interface{}{"x": int64(3)}, ""},
+		{"blanks kept in strings", "let s, \" a\tb \"", map[string]interface{}{"s": " a\tb "}, ""},
+	})
+}
+
+func TestInlineLabel(t *testing.T) {
+	run_cases(t, []script_case{
+		{"loop on a labelled line", "let i, 0\n@loop add i, 1, i\ncmp i, \"<\", 5, c\nwhen c, @loop", map[string]interface{}{"i": int64(5)}, ""},
+		{"tab after label", "goto @skip\nlet x, 1\n@skip\tlet y, 2", map[string]interface{}{"x": unbound, "y": int64(2)}, ""},
+		{"label alone still works", "goto @end\nlet x, 1\n@end", map[string]interface{}{"x": unbound}, ""},
+		{"unknown instruction after label", "@l bogus", nil, "Unknown instruction bogus"},
+	})
+}
+
+func TestSemicolon(t *testing.T) {
+	run_cases(t, []script_case{
+		{"several statements", "let a, 1; let b, 2; add a, b, c", map[string]interface{}{"c": int64(3)}, ""},
+		{"inside a string", "let s, \"a;b\"; let t, 'c;d'", map[string]interface{}{"s": "a;b", "t": "c;d"}, ""},
+		{"empty statements", "let a, 1;; ;let b, 2;", map[string]interface{}{"a": int64(1), "b": int64(2)}, ""},
+		{"label then statements", "let i, 0\n@l add i, 1, i; cmp i, \"<\", 4, c; when c, @l", map[string]interface{}{"i": int64(4)}, ""},
+		{"error names the line", "nop\nlet a, 1; bogus", nil, "In line 2,"},
+	})
+}
+
+func TestJump(t *testing.T) {
+	dispatch := "let n, 2\nstr s, n\ncat \"@case_\", s, target\njump target\n@case_1 let r, \"one\"; goto @end\n@case_2 let r, \"two\"; goto @end\n@end"
+	run_cases(t, []script_case{
+		{"computed label", dispatch, map[string]interface{}{"r": "two"}, ""},
+		{"literal name", "jump \"@b\"\n@a let x, 1\n@b let y, 1", map[string]interface{}{"x": unbound, "y": int64(1)}, ""},
+		{"unset label", "jump \"@nowhere\"", nil, "Unset label @nowhere"},
+		{"needs a str", "jump 1", nil, "Type mismatch"},
+	})
+}
+
+func TestLabeladdr(t *testing.T) {
+	run_cases(t, []script_case{
+		{"own line", "nop\nnop\n@l\nlabeladdr @l, a", map[string]interface{}{"a": int64(2)}, ""},
+		{"inline label", "labeladdr @l, a\n@l let x, 1", map[string]interface{}{"a": int64(1)}, ""},
+		{"unset label", "labeladdr @nowhere, a", nil, "Unset label @nowhere"},
+		{"needs a label", "labeladdr \"@l\", a\n@l", nil, "Type mismatch"},
+	})
+}
+
+func TestGotoidx(t *testing.T) {
+	table := "let n, 1\nlabeladdr @t0, a0\nlabeladdr @t1, a1\ncmp n, \"==\", 1, is_one\nselect is_one, a1, a0, target\ngotoidx target\n@t0 let r, 0; goto @end\n@t1 let r, 1\n@end"
+	run_cases(t, []script_case{
+		{"jump table", table, map[string]interface{}{"r": int64(1)}, ""},
+		{"same as goto", "labeladdr @l, a\ngotoidx a\nlet skipped, true\n@l let x, 1", map[string]interface{}{"skipped": unbound, "x": int64(1)}, ""},
+		{"negative index", "gotoidx -1", nil, "Instruction index -1 out of range"},
+		{"past the end", "gotoidx 5", nil, "Instruction index 5 out of range"},
+	})
+}
+
+// A jump must run its target instruction, not the one after it
+func TestJumpLanding(t *testing.T) {
+	run_cases(t, []script_case{
+		{"labelled instruction runs", "let n, 0\n@l add n, 1, n\ncmp n, \"<\", 3, c\nwhen c, @l", map[string]interface{}{"n": int64(3)}, ""},
+		{"to index zero", "let n, 0\nlabeladdr @top, top\n@top add n, 1, n\ncmp n, \"<\", 4, c\nwhen c, @back\ngoto @end\n@back gotoidx 2\n@end", map[string]interface{}{"n": int64(4)}, ""},
+		{"to the last instruction", "goto @last\nlet x, 1\n@last let y, 1", map[string]interface{}{"x": unbound, "y": int64(1)}, ""},
+		{"when false falls through", "let c, false\nwhen c, @l\nlet x, 1\n@l", map[string]interface{}{"x": int64(1)}, ""},
+	})
+	vm, out := new_test_vm()
+	vm.SetVar("n", 0)
+	// gotoidx 0 reruns the first instruction
+	_, err := run_on(vm, out, "add n, 1, n\ncmp n, \"<\", 3, c\nwhen c, @again\ngoto @end\n@again gotoidx 0\n@end")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chk_vars(t, vm, map[string]interface{}{"n": int64(3)})
+}
+
+func TestStrictFloat(t *testing.T) {
+	inf := math.Inf(1)
+	run_cases(t, []script_case{
+		{"inf allowed by default", "mul 1e300, 1e300, x", map[string]interface{}{"x": inf}, ""},
+		{"int at the limit", "sub -9223372036854775807, 1, x", map[string]interface{}{"x": int64(math.MinInt64)}, ""},
+	})
+	strict := func(vm *IcebergVM) {
+		vm.StrictFloat = true
+		vm.SetVar("inf", inf)
+	}
+	run_cases_with(t, strict, []script_case{
+		{"finite", "mul 1.5, 2.0, x", map[string]interface{}{"x": 3.0}, ""},
+		{"infinite", "mul 1e300, 1e300, x", nil, "Math ERROR: Result is infinite"},
+		{"nan", "sub inf, inf, x", nil, "Math ERROR: Result is NaN"},
+		{"pow", "pow 10.0, 400.0, x", nil, "Math ERROR: Result is infinite"},
+	})
+}
+
+func TestIsnanIsinf(t *testing.T) {
+	setup := func(vm *IcebergVM) {
+		vm.SetVar("inf", math.Inf(-1))
+		vm.SetVar("nan", math.NaN())
+	}
+	run_cases_with(t, setup, []script_case{
+		{"nan", "isnan nan, a\nisinf nan, b", map[string]interface{}{"a": true, "b": false}, ""},
+		{"inf", "isnan inf, a\nisinf inf, b", map[string]interface{}{"a": false, "b": true}, ""},
+		{"finite", "isnan 1.5, a\nisinf 1.5, b", map[string]interface{}{"a": false, "b": false}, ""},
+		{"computed", "mul 1e300, 1e300, x\nisinf x, a", map[string]interface{}{"a": true}, ""},
+		{"ints are finite", "isnan 3, a\nisinf 3, b", map[string]interface{}{"a": false, "b": false}, ""},
+		{"strings rejected", "isnan \"nan\", a", nil, "Type mismatch"},
+	})
+}
+
+func TestHypot(t *testing.T) {
+	run_cases(t, []script_case{
+		{"ints", "hypot 3, 4, x", map[string]interface{}{"x": 5.0}, ""},
+		{"mixed", "hypot 5.0, 12, x", map[string]interface{}{"x": 13.0}, ""},
+		{"negative", "hypot -3, -4, x", map[string]interface{}{"x": 5.0}, ""},
+		{"no overflow in between", "hypot 1e300, 1e300, x\nisinf x, b", map[string]interface{}{"b": false}, ""},
+		{"strings rejected", "hypot \"3\", 4, x", nil, "Type mismatch"},
+	})
+}
+
+func TestPowmod(t *testing.T) {
+	run_cases(t, []script_case{
+		{"small", "powmod 4, 13, 497, x", map[string]interface{}{"x": int64(445)}, ""},
+		{"large exponent", "powmod 3, 200, 1000000007, x", map[string]interface{}{"x": int64(136318165)}, ""},
+		{"no overflow", "powmod 9223372036854775807, 2, 9223372036854775806, x", map[string]interface{}{"x": int64(1)}, ""},
+		{"negative base", "powmod -2, 3, 5, x", map[string]interface{}{"x": int64(2)}, ""},
+		{"zero exponent", "powmod 7, 0, 13, x", map[string]interface{}{"x": int64(1)}, ""},
+		{"negative exponent", "powmod 2, -1, 5, x", nil, "Math ERROR: Negative exponent"},
+		{"zero modulus", "powmod 2, 3, 0, x", nil, "Math ERROR: Modulus must be positive"},
+		{"floats rejected", "powmod 2.0, 3, 5, x", nil, "Type mismatch"},
+	})
+}
+
+func TestGcdLcm(t *testing.T) {
+	run_cases(t, []script_case{
+		{"gcd", "gcd 12, 18, x", map[string]interface{}{"x": int64(6)}, ""},
+		{"gcd negative", "gcd 12, -18, x", map[string]interface{}{"x": int64(6)}, ""},
+		{"gcd zero", "gcd 0, 0, x\ngcd 0, 5, y", map[string]interface{}{"x": int64(0), "y": int64(5)}, ""},
+		{"lcm", "lcm 4, 6, x", map[string]interface{}{"x": int64(12)}, ""},
+		{"lcm zero", "lcm 0, 5, x", map[string]interface{}{"x": int64(0)}, ""},
+		{"lcm negative", "lcm -4, 6, x", map[string]interface{}{"x": int64(12)}, ""},
+		{"lcm overflow", "lcm 9223372036854775807, 2, x", nil, "Math ERROR: Integer overflow"},
+		{"floats rejected", "gcd 1.0, 2, x", nil, "expected int but got float"},
+	})
+}
+
+func TestSign(t *testing.T) {
+	setup := func(vm *IcebergVM) {
+		vm.SetVar("nan", math.NaN())
+	}
+	run_cases_with(t, setup, []script_case{
+		{"negative int", "sign -7, x", map[string]interface{}{"x": int64(-1)}, ""},
+		{"zero", "sign 0, x\nsign 0.0, y", map[string]interface{}{"x": int64(0), "y": int64(0)}, ""},
+		{"positive float", "sign 2.5, x", map[string]interface{}{"x": int64(1)}, ""},
+		{"negative float", "sign -1e-300, x", map[string]interface{}{"x": int64(-1)}, ""},
+		{"nan", "sign nan, x", nil, "NaN"},
+		{"strings rejected", "sign \"1\", x", nil, "Type mismatch"},
+	})
+}
+
+func TestGetenv(t *testing.T) {
+	setup := func(vm *IcebergVM) {
+		vm.Environ = func(name string) (string, bool) {
+			if name == "HOME" {
+				return "/home/ice", true
+			}
+			return "", false
+		}
+	}
+	run_cases_with(t, setup, []script_case{
+		{"set", "getenv \"HOME\", v, found", map[string]interface{}{"v": "/home/ice", "found": true}, ""},
+		{"unset", "getenv \"NOPE\", v, found", map[string]interface{}{"v": "", "found": false}, ""},
+		{"needs a str", "getenv 1, v, found", nil, "Type mismatch"},
+	})
+}
+
+// An in-memory FileSystem
+type map_fs map[string]string
+
+type map_file struct {
+	bytes.Buffer
+	fs map_fs
+	name string
+}
+
+func (file *map_file) Close() error {
+	file.fs[file.name] = file.String()
+	return nil
+}
+func (fs map_fs) Open(name string) (io.ReadCloser, error) {
+	content, exist := fs[name]
+	if !exist {
+		return nil, os.ErrNotExist
+	}
+	return io.NopCloser(strings.NewReader(content)), nil
+}
+func (fs map_fs) Create(name string) (io.WriteCloser, error) {
+	return &map_file{fs: fs, name: name}, nil
+}
+
+func TestReadWriteFile(t *testing.T) {
+	fs := map_fs{"in.txt": "hello"}
+	setup := func(vm *IcebergVM) {
+		vm.FS = fs
+	}
+	run_cases_with(t, setup, []script_case{
+		{"read", "readfile \"in.txt\", s", map[string]interface{}{"s": "hello"}, ""},
+		{"write then read", "writefile \"out.txt\", \"a\nb\"\nreadfile \"out.txt\", s", map[string]interface{}{"s": "a\nb"}, ""},
+		{"missing", "readfile \"nope.txt\", s", nil, "System ERROR: readfile failed"},
+		{"needs a str", "writefile \"out.txt\", 1", nil, "Type mismatch"},
+	})
+	if fs["out.txt"] != "a\nb" {
+		t.Errorf("out.txt holds %q", fs["out.txt"])
+	}
+}
+
+func TestCatInPlace(t *testing.T) {
+	run_cases(t, []script_case{
+		{"append to itself", "let s, \"a\"\ncat s, \"b\", s\ncat s, \"c\", s", map[string]interface{}{"s": "abc"}, ""},
+		{"prepend", "let s, \"a\"\ncat \"b\", s, s", map[string]interface{}{"s": "ba"}, ""},
+		{"copies stay apart", "let s, \"ab\"\ncat s, \"c\", s\nlet t, s\ncat s, \"X\", s\ncat t, \"Y\", t", map[string]interface{}{"s": "abcX", "t": "abcY"}, ""},
+		{"pushed copy unchanged", "let s, \"ab\"\ncat s, \"c\", s\npush s\ncat s, \"X\", s\npop t", map[string]interface{}{"s": "abcX", "t": "abc"}, ""},
+		{"outer scope", "let s, \"a\"\npushscope\ncat s, \"b\", s\nlet inner, s\npopscope", map[string]interface{}{"s": "a", "inner": unbound}, ""},
+		{"other type", "let s, 1\ncat s, \"b\", s", nil, "Type mismatch"},
+	})
+}
+
+func cat_loop_script(n_pieces int) string {
+	return fmt.Sprintf("let s, \"\"\nlet i, 0\n@l cat s, \"piece\", s\nadd i, 1, i\ncmp i, \"<\", %d, c\nwhen c, @l\nbytelen s, n", n_pieces)
+}
+
+func TestCatLoop(t *testing.T) {
+	vm, _, err := run_script(cat_loop_script(10000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chk_vars(t, vm, map[string]interface{}{"n": int64(50000)})
+}
+
+func BenchmarkCat10k(b *testing.B) {
+	vm, _ := new_test_vm()
+	code := vm.Gen_bytecode(cat_loop_script(10000))
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		vm.Reset()
+		err := vm.Run(code)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestGetArgument(t *testing.T) {
+	vm, _ := new_test_vm()
+	vm.SetVar("i", 1000)
+	vm.SetVar("f", 2.5)
+	vm.SetVar("b", true)
+	vm.SetVar("s", "str")
+	cases := []struct {
+		symbol string
+		want interface{}
+		e_type int64
+		max_allocs float64
+	}{
+		{"i", int64(1000), T_INT, 1},
+		{"f", 2.5, T_FLOAT, 1},
+		{"b", true, T_BOOL, 0},
+		// A string is copied out of Data before boxing
+		{"s", "str", T_STR, 2},
+	}
+	for _, c := range cases {
+		arg := vm.conv_arg([]byte(c.symbol))
+		got, e_type := vm.Get_argument(arg, T_ANY)
+		if got != c.want || e_type != c.e_type {
+			t.Errorf("%s: got %#v type %d, expected %#v type %d", c.symbol, got, e_type, c.want, c.e_type)
+		}
+		allocs := testing.AllocsPerRun(100, func() {
+			vm.Get_argument(arg, T_ANY)
+		})
+		if allocs > c.max_allocs {
+			t.Errorf("%s: %v allocations per call", c.symbol, allocs)
+		}
+	}
+
+	short := []Entity{{[]byte{1}, T_INT}, {[]byte{}, T_FLOAT}, {[]byte{}, T_BOOL}}
+	for _, e := range short {
+		_, err := decode_entity(e)
+		if err == nil {
+			t.Errorf("decode_entity accepted %d bytes of type %d", len(e.Data), e.E_type)
+		}
+	}
+}
+
+const arith_loop_script = "let i, 0\nlet f, 0.5\n@l add i, 1, i\nmul f, 1.0, f\ncmp i, \"<\", 1000, c\nwhen c, @l"
+
+func BenchmarkArithLoop(b *testing.B) {
+	vm, _ := new_test_vm()
+	code := vm.Gen_bytecode(arith_loop_script)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		vm.Reset()
+		err := vm.Run(code)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func long_script(n_lines int) string {
+	lines := make([]string, n_lines)
+	for i := range lines {
+		lines[i] = "add x, 1, x"
+	}
+	return "let x, 0\n" + strings.Join(lines, "\n")
+}
+
+func TestCompileLong(t *testing.T) {
+	vm, _ := new_test_vm()
+	code, err := vm.Compile(long_script(10000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code.inst_list) != 10001 {
+		t.Fatalf("compiled %d instructions, expected 10001", len(code.inst_list))
+	}
+	err = vm.Run(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chk_vars(t, vm, map[string]interface{}{"x": int64(10000)})
+
+	// A second compilation must not share instructions with the first
+	other, err := vm.Compile("let x, 0\nsub x, 1, x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code.inst_list[1].Inst != "add" || other.inst_list[1].Inst != "sub" {
+		t.Error("compilations share their instruction lists")
+	}
+}
+
+func BenchmarkCompile10kLines(b *testing.B) {
+	vm, _ := new_test_vm()
+	script := long_script(10000)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		_, err := vm.Compile(script)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSetLabels(t *testing.T) {
+	vm, _ := new_test_vm()
+	code, err := vm.Compile("let x, 1\n@a\n@b add x, 1, x\ngoto @a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	insts := []string{"let", "nop", "nop", "add", "goto"}
+	if len(code.inst_list) != len(insts) {
+		t.Fatalf("got %d instructions, expected %d", len(code.inst_list), len(insts))
+	}
+	for i, inst := range insts {
+		if code.inst_list[i].Inst != inst {
+			t.Errorf("instruction %d: got %s, expected %s", i, code.inst_list[i].Inst, inst)
+		}
+	}
+	if len(code.label_table) != 2 || code.label_table["@a"] != 1 || code.label_table["@b"] != 2 {
+		t.Errorf("got label table %v", code.label_table)
+	}
+}
+
+func repeated_literal_script(n_copies int) string {
+	literal := "\"" + strings.Repeat("iceberg", 100) + "\""
+	lines := make([]string, n_copies)
+	for i := range lines {
+		lines[i] = "let s, " + literal
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestLiteralSharing(t *testing.T) {
+	vm, _ := new_test_vm()
+	code, err := vm.Compile(repeated_literal_script(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := &code.inst_list[0].Args[1].Data[0]
+	for i, instr := range code.inst_list {
+		if &instr.Args[1].Data[0] != first {
+			t.Fatalf("instruction %d has its own copy of the literal", i)
+		}
+	}
+	if vm.literal_pool != nil {
+		t.Error("the literal pool outlived the compilation")
+	}
+
+	// Each literal is 700 bytes, so 1000 unshared copies would keep at least 700000 alive
+	script := repeated_literal_script(1000)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	code, err = vm.Compile(script)
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retained := int64(after.HeapAlloc) - int64(before.HeapAlloc)
+	if retained > 350000 {
+		t.Errorf("compiled bytecode holds %d bytes", retained)
+	}
+
+	// Appending in place to a variable must not reach the shared literal
+	vm2, out := new_test_vm()
+	_, err = run_on(vm2, out, "let s, \"lit\"\ncat s, \"X\", s\nlet t, \"lit\"\ncat t, \"Y\", t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chk_vars(t, vm2, map[string]interface{}{"s": "litX", "t": "litY"})
+	runtime.KeepAlive(code)
+}
+
+func BenchmarkCompileRepeatedLiteral(b *testing.B) {
+	vm, _ := new_test_vm()
+	script := repeated_literal_script(1000)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		_, err := vm.Compile(script)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestEvalLine(t *testing.T) {
+	vm, out := new_test_vm()
+	steps := []struct {
+		line string
+		want_err string
+	}{
+		{"let x, 1", ""},
+		{"add x, 2, x", ""},
+		{"let a, \"p;q\"; let b, 2 # comment", ""},
+		{"bogus 1", "In line 1,\nSyntax ERROR: Unknown instruction bogus"},
+		{"let ok, true; bogus", "In line 1,"},
+		{"div 1, 0, q", "Math ERROR"},
+		{"let i, 0", ""},
+		{"@l add i, 1, i", ""},
+		{"cmp i, \"<\", 3, c; when c, @l", ""},
+		{"print x, a", ""},
+	}
+	for _, step := range steps {
+		err := vm.EvalLine(step.line)
+		if step.want_err == "" && err != nil {
+			t.Fatalf("%q: %v", step.line, err)
+		}
+		if step.want_err != "" && (err == nil || !strings.Contains(err.Error(), step.want_err)) {
+			t.Fatalf("%q: got %v, expected %q", step.line, err, step.want_err)
+		}
+	}
+	chk_vars(t, vm, map[string]interface{}{"x": int64(3), "a": "p;q", "b": int64(2), "ok": unbound, "i": int64(3)})
+	if out.String() != "3 p;q\n" {
+		t.Errorf("printed %q", out.String())
+	}
+
+	// Variables are shared with Run
+	_, err := run_on(vm, out, "add x, 10, x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chk_vars(t, vm, map[string]interface{}{"x": int64(13)})
+}
+
+func TestInstructionNames(t *testing.T) {
+	vm, _ := new_test_vm()
+	names := vm.InstructionNames()
+	if len(names) != len(vm.Inst_table) {
+		t.Fatalf("got %d names for %d instructions", len(names), len(vm.Inst_table))
+	}
+	if !sort.StringsAreSorted(names) {
+		t.Error("names are not sorted")
+	}
+	vm.RegisterInstruction("zz_custom", InstructionDesc{ func(args []Entity) {}, 0, 0, "", })
+	names = vm.InstructionNames()
+	if names[len(names)-1] != "zz_custom" {
+		t.Errorf("custom instruction missing, last name is %s", names[len(names)-1])
+	}
+	for _, name := range names {
+		_, exist := vm.Inst_table[name]
+		if !exist {
+			t.Errorf("%s is not registered", name)
+		}
+	}
+}
+
+func TestInstructionArity(t *testing.T) {
+	vm, _ := new_test_vm()
+	cases := []struct {
+		name string
+		want int64
+		exist bool
+	}{
+		{"nop", 0, true},
+		{"add", 3, true},
+		{"powmod", 4, true},
+		{"padleft", 3, true},
+		{"print", 0, true},
+		{"bogus", 0, false},
+	}
+	for _, c := range cases {
+		got, exist := vm.InstructionArity(c.name)
+		if got != c.want || exist != c.exist {
+			t.Errorf("%s: got %d %v, expected %d %v", c.name, got, exist, c.want, c.exist)
+		}
+	}
+}
+
+func TestVariadic(t *testing.T) {
+	vm, out := new_test_vm()
+	var got_nargs int
+	count := func(args []Entity) {
+		got_nargs = len(args)
+	}
+	vm.RegisterInstruction("range13", InstructionDesc{ count, 1, 3, "", })
+	vm.RegisterInstruction("atleast2", InstructionDesc{ count, 2, N_UNLIMITED, "", })
+	cases := []struct {
+		script string
+		nargs int
+		want_err string
+	}{
+		{"range13 1", 1, ""},
+		{"range13 1, 2, 3", 3, ""},
+		{"range13", 0, "Too few arguments(at least 1 expected but 0 given)"},
+		{"range13 1, 2, 3, 4", 0, "Too many arguments(at most 3 expected but 4 given)"},
+		{"atleast2 1, 2", 2, ""},
+		{"atleast2 1, 2, 3, 4, 5, 6, 7", 7, ""},
+		{"atleast2 1", 0, "Too few arguments(at least 2 expected but 1 given)"},
+	}
+	for _, c := range cases {
+		got_nargs = -1
+		_, err := run_on(vm, out, c.script)
+		if c.want_err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.want_err) {
+				t.Errorf("%q: got %v, expected %q", c.script, err, c.want_err)
+			}
+			continue
+		}
+		if err != nil || got_nargs != c.nargs {
+			t.Errorf("%q: got %d args and %v, expected %d", c.script, got_nargs, err, c.nargs)
+		}
+	}
+}
+
+type output_case struct {
+	script string
+	want string
+}
+
+func run_output_cases(t *testing.T, cases []output_case) {
+	t.Helper()
+	for _, c := range cases {
+		_, output, err := run_script(c.script)
+		if err != nil {
+			t.Errorf("%q: %v", c.script, err)
+		} else if output != c.want {
+			t.Errorf("%q: printed %q, expected %q", c.script, output, c.want)
+		}
+	}
+}
+
+func TestPrint(t *testing.T) {
+	run_output_cases(t, []output_case{
+		{"print 1, 2.5, \"s\"", "1 2.5 s\n"},
+		{"print true, false", "true false\n"},
+		{"print", "\n"},
+		{"let x, 3\nprint x, \"a b\"", "3 a b\n"},
+		{"print 2.0, nil", "2.0 nil\n"},
+		{"str s, true\nstr f, false\nprint s, f", "true false\n"},
+	})
+	_, _, err := run_script("print missing")
+	chk_result(t, err, "Unbound symbol missing")
+}
+
+func TestDump(t *testing.T) {
+	script := "let zeta, 1\nlet alpha, \"x\"\nlet mid, 1.5\nlet none, nil\ndump"
+	want := "Dump begin ---\nVariable Symbol Table:\nalpha -> x <type: 8>\nmid -> 1.5 <type: 2>\nnone -> nil <type: 32>\nzeta -> 1 <type: 1>\nDump end---\n"
+	// Sorted, so the same on every run
+	for i := 0; i < 5; i++ {
+		run_output_cases(t, []output_case{
+			{script, want},
+		})
+	}
+	run_output_cases(t, []output_case{
+		{"let outer, 1\npushscope\nlet inner, 2\ndump", "Dump begin ---\nVariable Symbol Table:\ninner -> 2 <type: 1>\nDump end---\n"},
+	})
+}
+
+func TestDumpString(t *testing.T) {
+	vm, out := new_test_vm()
+	_, err := run_on(vm, out, "let b, true\nlet a, 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Dump begin ---\nVariable Symbol Table:\na -> 2 <type: 1>\nb -> true <type: 4>\nDump end---\n"
+	if vm.DumpString() != want {
+		t.Errorf("got %q, expected %q", vm.DumpString(), want)
+	}
+	if out.Len() != 0 {
+		t.Errorf("DumpString printed %q", out.String())
+	}
+	_, err = run_on(vm, out, "dump")
+	if err != nil || out.String() != want {
+		t.Errorf("dump printed %q, DumpString gave %q", out.String(), want)
+	}
+}
+
+func TestEntityString(t *testing.T) {
+	vm, _ := new_test_vm()
+	cases := []struct {
+		literal string
+		want string
+	}{
+		{"42", "42:int"},
+		{"-1.5", "-1.5:float"},
+		{"true", "true:bool"},
+		{"\"hi\\tthere\"", "\"hi\\\\tthere\":str"},
+		{"'say \"x\"'", "\"say \\\"x\\\"\":str"},
+		{"@l", "@l:label"},
+		{"nil", "nil"},
+		{"sym", "sym"},
+	}
+	for _, c := range cases {
+		got := vm.conv_arg([]byte(c.literal)).String()
+		if got != c.want {
+			t.Errorf("%s: got %s, expected %s", c.literal, got, c.want)
+		}
+	}
+	bad := Entity{[]byte{1}, T_INT}
+	if bad.String() != "<invalid>:1" {
+		t.Errorf("got %s for a truncated int", bad.String())
+	}
+	if fmt.Sprint(vm.conv_arg([]byte("7"))) != "7:int" {
+		t.Error("Entity does not implement fmt.Stringer")
+	}
+}
+
+func TestTypeName(t *testing.T) {
+	cases := []struct {
+		e_type int64
+		want string
+	}{
+		{T_UNDET, "undet"},
+		{T_INT, "int"},
+		{T_FLOAT, "float"},
+		{T_BOOL, "bool"},
+		{T_STR, "str"},
+		{T_LABEL, "label"},
+		{T_NIL, "nil"},
+		{T_INT | T_FLOAT, "int|float"},
+		{T_ANY, "any"},
+		{T_ANY ^ T_LABEL, "int|float|bool|str|nil"},
+		{T_INT | 64, "int|unknown(64)"},
+	}
+	for _, c := range cases {
+		got := TypeName(c.e_type)
+		if got != c.want {
+			t.Errorf("%d: got %s, expected %s", c.e_type, got, c.want)
+		}
+	}
+}
+
+func TestTypeMismatchMessages(t *testing.T) {
+	run_cases(t, []script_case{
+		{"operand", "add \"a\", 1, x", nil, "Type ERROR: Type mismatch, expected int|float but got str"},
+		{"bool operand", "not 1, x", nil, "Type ERROR: Type mismatch, expected bool but got int"},
+		{"label", "goto \"@l\"\n@l", nil, "Type ERROR: Type mismatch, expected label but got str"},
+		{"destination", "let x, 1\nlet x, 2.5", nil, "Type ERROR: Type mismatch, x holds int but got float"},
+		{"symbol expected", "let 1, 2", nil, "Type ERROR: Type mismatch, expected a symbol but got int"},
+	})
+}
+
+func TestSetInputs(t *testing.T) {
+	vm, out := new_test_vm()
+	err := vm.SetInputs(map[string]interface{}{"a": 2, "b": 3.5, "name": "ice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = run_on(vm, out, "add a, b, sum\ncat \"hi \", name, greeting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chk_vars(t, vm, map[string]interface{}{"sum": 5.5, "greeting": "hi ice"})
+
+	// One bad input leaves every variable as it was
+	bad_inputs := []map[string]interface{}{
+		{"a": 10, "c": 1, "sum": "not a float"},
+		{"a": 10, "c": 1, "d": []int{}},
+		{"a": 10, "c": 1, "12": 1},
+	}
+	for _, inputs := range bad_inputs {
+		err = vm.SetInputs(inputs)
+		if err == nil {
+			t.Errorf("%v: no error", inputs)
+		} else if strings.Contains(err.Error(), "instruction number") {
+			t.Errorf("%v: host call error names an instruction: %v", inputs, err)
+		}
+		chk_vars(t, vm, map[string]interface{}{"a": int64(2), "c": unbound})
+	}
+}
+
+func TestClone(t *testing.T) {
+	vm, out := new_test_vm()
+	vm.StrictFloat = true
+	vm.CommentPrefix = "//"
+	vm.MaxStringLen = 100
+	vm.RegisterVMInstruction("double", func(vm *IcebergVM, args []Entity) {
+		x, _ := vm.Get_argument(args[0], T_INT)
+		vm.Assign_var(vm.Get_baresymbol(args[1]), x.(int64) * 2)
+	}, 2, 0, "double x, dest")
+	_, err := run_on(vm, out, "let s, \"ab\"\ncat s, \"c\", s\npush 7\nlet n, 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clone := vm.Clone()
+	clone_out := new(bytes.Buffer)
+	clone.Stdout = clone_out
+	if !clone.StrictFloat || clone.CommentPrefix != "//" || clone.MaxStringLen != 100 {
+		t.Error("configuration not copied")
+	}
+	_, err = run_on(clone, clone_out, "cat s, \"X\", s // in place\npop p\nadd n, 1, n\ndouble n, d\nprint s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chk_vars(t, clone, map[string]interface{}{"s": "abcX", "p": int64(7), "n": int64(2), "d": int64(4)})
+	// The original is untouched, and nothing went to its Stdout
+	chk_vars(t, vm, map[string]interface{}{"s": "abc", "n": int64(1), "d": unbound})
+	if len(vm.value_stack) != 1 || out.Len() != 0 || clone_out.String() != "abcX\n" {
+		t.Errorf("original stack %v, output %q; clone output %q", vm.value_stack, out.String(), clone_out.String())
+	}
+	doc, _ := clone.Help("double")
+	if doc != "double x, dest" {
+		t.Errorf("Help on the clone gave %q", doc)
+	}
+
+	// A plain custom instruction keeps acting on the VM its function was bound to
+	vm.RegisterInstruction("mark", InstructionDesc{ func(args []Entity) {
+		vm.Assign_var("marked", true)
+	}, 0, 0, "", })
+	clone = vm.Clone()
+	_, err = run_on(clone, clone_out, "mark")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chk_vars(t, vm, map[string]interface{}{"marked": true})
+	chk_vars(t, clone, map[string]interface{}{"marked": unbound})
+
+	// Replacing a RegisterVMInstruction instruction stops it being rebound
+	vm.RegisterInstruction("double", InstructionDesc{ func(args []Entity) {
+		vm.Assign_var("replaced", true)
+	}, 2, 0, "", })
+	clone = vm.Clone()
+	_, err = run_on(clone, clone_out, "double 1, d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chk_vars(t, vm, map[string]interface{}{"replaced": true})
+	chk_vars(t, clone, map[string]interface{}{"replaced": unbound})
+
+	// Swapping in another RegisterVMInstruction function also stops the rebinding
+	vm.RegisterVMInstruction("one", func(vm *IcebergVM, args []Entity) {
+		vm.Assign_var("which", int64(1))
+	}, 0, 0, "")
+	vm.RegisterVMInstruction("two", func(vm *IcebergVM, args []Entity) {
+		vm.Assign_var("which", int64(2))
+	}, 0, 0, "")
+	vm.Inst_table["one"] = vm.Inst_table["two"]
+	clone = vm.Clone()
+	_, err = run_on(clone, clone_out, "one\ntwo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chk_vars(t, vm, map[string]interface{}{"which": int64(2)})
+	chk_vars(t, clone, map[string]interface{}{"which": int64(2)})
+	_, err = run_on(clone, clone_out, "let which, 0\none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chk_vars(t, clone, map[string]interface{}{"which": int64(0)})
+
+	// So does overriding a built-in, even with another built-in
+	vm.RegisterInstruction("not", InstructionDesc{ func(args []Entity) {
+		vm.Assign_var("overridden", true)
+	}, 2, 0, "", })
+	vm.Inst_table["neg"] = vm.Inst_table["sub"]
+	vm.Inst_table["sub"] = vm.Inst_table["add"]
+	clone = vm.Clone()
+	_, err = run_on(clone, clone_out, "not true, b\nsub 5, 1, diff\nneg 0, 1, neg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chk_vars(t, vm, map[string]interface{}{"overridden": true, "diff": int64(6), "neg": int64(-1)})
+	chk_vars(t, clone, map[string]interface{}{"overridden": unbound, "b": unbound, "diff": unbound, "neg": unbound})
+
+	// An edited built-in keeps its edits, and is still rebound
+	desc := vm.Inst_table["add"]
+	desc.Doc = "add a, b, dest; edited"
+	vm.Inst_table["add"] = desc
+	clone = vm.Clone()
+	doc, _ = clone.Help("add")
+	if doc != "add a, b, dest; edited" {
+		t.Errorf("Help on the clone gave %q", doc)
+	}
+	_, err = run_on(clone, clone_out, "add 1, 2, sum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chk_vars(t, vm, map[string]interface{}{"sum": unbound})
+	chk_vars(t, clone, map[string]interface{}{"sum": int64(3)})
+
+	err = vm.RegisterVMInstruction("nofunc", nil, 0, 0, "")
+	chk_result(t, err, "Argument ERROR: Instruction nofunc has no function")
+	var ice_err *IcebergError
+	if !errors.As(err, &ice_err) || ice_err.Kind != ERR_ARGUMENT {
+		t.Errorf("got %#v, expected an argument *IcebergError", err)
+	}
+}
+
+func chk_copy_panics(t *testing.T, what string, f func()) {
+	t.Helper()
+	defer func() {
+		r := recover()
+		message, ok := r.(string)
+		if !ok || !strings.Contains(message, "use Clone to copy") {
+			t.Errorf("%s: got panic %#v", what, r)
+		}
+	}()
+	f()
+}
+
+func TestCopySafety(t *testing.T) {
+	vm, _ := new_test_vm()
+	code := vm.Gen_bytecode("let x, 1")
+	copied := *vm
+	chk_copy_panics(t, "Run on a copy", func() {
+		copied.Run(code)
+	})
+	chk_copy_panics(t, "EvalLine on a copy", func() {
+		copied.EvalLine("let x, 1")
+	})
+	chk_copy_panics(t, "Reset on a copy", func() {
+		copied.Reset()
+	})
+	var uninitialized IcebergVM
+	chk_copy_panics(t, "Run without Init", func() {
+		uninitialized.Run(code)
+	})
+
+	// The original is still usable and was not touched through the copy
+	err := vm.Run(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chk_vars(t, vm, map[string]interface{}{"x": int64(1)})
+	// Init on the copy makes it a VM of its own
+	copied.Init()
+	err = copied.Run(copied.Gen_bytecode("let y, 2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chk_vars(t, &copied, map[string]interface{}{"y": int64(2)})
+	chk_vars(t, vm, map[string]interface{}{"y": unbound})
+}
+
+func TestStdout(t *testing.T) {
+	vm, out := new_test_vm()
+	_, err := run_on(vm, out, "int x, 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "WARNING:\nIn instruction number 0,\nUnnecessary cast") {
+		t.Errorf("warning not written to Stdout: %q", out.String())
+	}
+
+	out.Reset()
+	vm.Dump_bytecode(vm.Gen_bytecode("note \"hi\"\n@l\nlet x, 1"))
+	want := "0: note \"hi\"\n1: nop \n2: let 78<type: 0>, 0100000000000000<type: 1>, \nLabel table:\nmap[@l:1]\n"
+	if out.String() != want {
+		t.Errorf("got %q, expected %q", out.String(), want)
+	}
+}
+
+// The setup of misc/wasm: with Stdout, FS and Environ injected, a run touches
+// nothing in the os package and exit does not end the process
+func TestNoOS(t *testing.T) {
+	saved := os.Stdout
+	os_out, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = os_out
+	defer func() {
+		os.Stdout = saved
+	}()
+
+	vm, out := new_test_vm()
+	fs := map_fs{}
+	vm.FS = fs
+	vm.Environ = func(name string) (string, bool) {
+		return "", false
+	}
+	vm.Dump_bytecode(vm.Gen_bytecode("nop"))
+	_, err = run_on(vm, out, "int x, 1\nprint x\ndump\ngetenv \"HOME\", home, found\nwritefile \"out.txt\", \"a\"\ntry @h, e\nreadfile \"in.txt\", s\n@h exit 4\nlet after, true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chk_vars(t, vm, map[string]interface{}{"found": false, "s": unbound, "after": unbound})
+	if vm.ExitCode() != 4 || fs["out.txt"] != "a" {
+		t.Errorf("exit code %d, files %v", vm.ExitCode(), fs)
+	}
+	if !strings.Contains(out.String(), "0: nop") || !strings.Contains(out.String(), "WARNING:") || !strings.Contains(out.String(), "\n1\n") {
+		t.Errorf("output missing from Stdout: %q", out.String())
+	}
+	info, err := os_out.Stat()
+	if err != nil || info.Size() != 0 {
+		t.Errorf("wrote %d bytes to os.Stdout, err %v", info.Size(), err)
+	}
+}
+
+func TestSafeMode(t *testing.T) {
+	fs := map_fs{"in.txt": "secret"}
+	called := false
+	setup := func(vm *IcebergVM) {
+		vm.SafeMode = true
+		vm.FS = fs
+		vm.Environ = func(name string) (string, bool) {
+			called = true
+			return "", false
+		}
+	}
+	run_cases_with(t, setup, []script_case{
+		{"getenv", "getenv \"HOME\", v, found", map[string]interface{}{"v": unbound}, "System ERROR: getenv is not allowed in safe mode"},
+		{"readfile", "readfile \"in.txt\", s", nil, "System ERROR: readfile is not allowed in safe mode"},
+		{"writefile", "writefile \"out.txt\", \"x\"", nil, "System ERROR: writefile is not allowed in safe mode"},
+		{"others still run", "add 1, 2, x\nprint x", map[string]interface{}{"x": int64(3)}, ""},
+		{"catchable", "try @denied, e\nreadfile \"in.txt\", s\n@denied", map[string]interface{}{"s": unbound}, ""},
+	})
+	_, written := fs["out.txt"]
+	if called || written {
+		t.Error("safe mode reached the environment or filesystem")
+	}
+}
+
+func TestMaxStringLen(t *testing.T) {
+	limit := func(vm *IcebergVM) {
+		vm.MaxStringLen = 8
+	}
+	run_cases_with(t, limit, []script_case{
+		{"at the limit", "cat \"1234\", \"5678\", s", map[string]interface{}{"s": "12345678"}, ""},
+		{"cat", "cat \"12345\", \"6789\", s", nil, "System ERROR: String of 9 bytes exceeds the limit of 8"},
+		{"cat in place", "let s, \"\"\n@l cat s, \"ab\", s\nbytelen s, n\ncmp n, \"<\", 100, c\nwhen c, @l", nil, "String of 10 bytes exceeds the limit of 8"},
+		{"padleft", "padleft \"a\", 20, s", nil, "exceeds the limit of 8"},
+		{"let of a literal", "let s, \"123456789\"", nil, "exceeds the limit of 8"},
+		{"str", "str s, 1234567890", nil, "exceeds the limit of 8"},
+	})
+
+	vm, _ := new_test_vm()
+	vm.MaxStringLen = 3
+	err := vm.SetVar("s", "long")
+	chk_result(t, err, "String of 4 bytes exceeds the limit of 3")
+}
+
+func TestMaxMemoryBytes(t *testing.T) {
+	limit := func(vm *IcebergVM) {
+		vm.MaxMemoryBytes = 64
+	}
+	run_cases_with(t, limit, []script_case{
+		{"within", "let a, 1\nlet b, \"0123456789\"", map[string]interface{}{"a": int64(1)}, ""},
+		{"growing string", "let s, \"\"\n@l cat s, \"0123456789\", s\nwhen true, @l", nil, "System ERROR: Memory limit of 64 bytes exceeded"},
+		{"stack", "@l push 1\nwhen true, @l", nil, "Memory limit of 64 bytes exceeded"},
+		{"overwrite is not growth", "let i, 0\n@l let s, \"0123456789\"\nadd i, 1, i\ncmp i, \"<\", 100, c\nwhen c, @l", map[string]interface{}{"i": int64(100)}, ""},
+		{"popscope releases", "let i, 0\n@l pushscope\nlet s, \"0123456789012345678901234567890123456789\"\npopscope\nadd i, 1, i\ncmp i, \"<\", 10, c\nwhen c, @l", map[string]interface{}{"i": int64(10)}, ""},
+		{"pop releases", "let i, 0\n@l push \"0123456789012345678901234567890123456789\"\npop s\nlet s, \"\"\nadd i, 1, i\ncmp i, \"<\", 10, c\nwhen c, @l", map[string]interface{}{"i": int64(10)}, ""},
+	})
+
+	vm, _ := new_test_vm()
+	vm.MaxMemoryBytes = 16
+	err := vm.SetVar("s", "0123456789abcdefg")
+	chk_result(t, err, "Memory limit of 16 bytes exceeded")
+
+	// Each input fits alone but not together, so none of them is stored
+	err = vm.SetInputs(map[string]interface{}{"a": "0123456789", "b": "0123456789"})
+	chk_result(t, err, "Memory limit of 16 bytes exceeded")
+	chk_vars(t, vm, map[string]interface{}{"a": unbound, "b": unbound})
+	if vm.mem_used != 0 {
+		t.Errorf("a failed SetInputs left mem_used at %d", vm.mem_used)
+	}
+	err = vm.SetInputs(map[string]interface{}{"a": "01234567", "b": "01234567"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	vm, _ := new_test_vm()
+	forever := vm.Gen_bytecode("let i, 0\n@l add i, 1, i\ngoto @l")
+	start := time.Now()
+	err := vm.RunTimeout(20 * time.Millisecond, forever)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, expected context.DeadlineExceeded", err)
+	}
+	if time.Since(start) > 2 * time.Second {
+		t.Errorf("stopped only after %v", time.Since(start))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = vm.RunContext(ctx, forever)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, expected context.Canceled", err)
+	}
+
+	// A program finishing in time is unaffected, and errors are still reported
+	err = vm.RunTimeout(time.Second, vm.Gen_bytecode("let j, 1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = vm.RunTimeout(time.Second, vm.Gen_bytecode("div 1, 0, x"))
+	chk_result(t, err, "Math ERROR")
+}
+
+func TestReset(t *testing.T) {
+	vm, out := new_test_vm()
+	vm.StrictFloat = true
+	vm.RegisterInstruction("custom", InstructionDesc{ func(args []Entity) {}, 0, 0, "", })
+	_, err := run_on(vm, out, "let x, 1\npush 2\npushscope\nlet y, 3\nexit 4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.EvalLine("@e let z, 5")
+
+	vm.Reset()
+	if len(vm.Vars()) != 0 || len(vm.value_stack) != 0 || len(vm.scope_stack) != 0 || vm.ExitCode() != 0 || vm.mem_used != 0 {
+		t.Errorf("state left after Reset: vars %v, stack %v, scopes %d, exit code %d, mem %d", vm.Vars(), vm.value_stack, len(vm.scope_stack), vm.ExitCode(), vm.mem_used)
+	}
+	// Configuration and instructions survive
+	if !vm.StrictFloat {
+		t.Error("Reset cleared StrictFloat")
+	}
+	_, err = run_on(vm, out, "custom\nlet x, \"now a str\"")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The EvalLine program is gone too
+	err = vm.EvalLine("goto @e")
+	chk_result(t, err, "Unset label @e")
+}
+
+func TestSelect(t *testing.T) {
+	run_cases(t, []script_case{
+		{"true", "select true, 1, 2, x", map[string]interface{}{"x": int64(1)}, ""},
+		{"false", "select false, \"a\", \"b\", x", map[string]interface{}{"x": "b"}, ""},
+		{"from cmp", "let n, 5\ncmp n, \">\", 3, big\nselect big, \"big\", \"small\", x", map[string]interface{}{"x": "big"}, ""},
+		{"mixed types", "select true, 1, \"a\", x", nil, "Type ERROR"},
+		{"cond must be bool", "select 1, 1, 2, x", nil, "expected bool but got int"},
+	})
+}
+
+func TestNote(t *testing.T) {
+	run_cases(t, []script_case{
+		{"does nothing", "let x, 1\nnote \"x is one\"\nadd x, 1, x", map[string]interface{}{"x": int64(2)}, ""},
+		{"needs a str", "note 1", nil, "Type mismatch"},
+	})
+	run_output_cases(t, []output_case{
+		{"note \"a, b\"", ""},
+	})
+	vm, out := new_test_vm()
+	vm.Dump_bytecode(vm.Gen_bytecode("note \"step 1\""))
+	if !strings.HasPrefix(out.String(), "0: note \"step 1\"\n") {
+		t.Errorf("Dump_bytecode printed %q", out.String())
+	}
+}
+
+func TestVersion(t *testing.T) {
+	run_cases(t, []script_case{
+		{"version", "version v", map[string]interface{}{"v": Version}, ""},
+	})
+	if !regexp.MustCompile(`^\d+\.\d+\.\d+$`).MatchString(Version) {
+		t.Errorf("Version %q is not semantic", Version)
+	}
+}
+
+func TestRegisterInstruction(t *testing.T) {
+	noop := func(args []Entity) {}
+	cases := []struct {
+		name string
+		desc InstructionDesc
+		want_err string
+	}{
+		{"greet", InstructionDesc{ noop, 1, 0, "", }, ""},
+		{"range", InstructionDesc{ noop, 1, 3, "", }, ""},
+		{"any", InstructionDesc{ noop, 0, N_UNLIMITED, "", }, ""},
+		{"", InstructionDesc{ noop, 0, 0, "", }, "Invalid instruction name \"\""},
+		{"two words", InstructionDesc{ noop, 0, 0, "", }, "Invalid instruction name"},
+		{"@label", InstructionDesc{ noop, 0, 0, "", }, "Invalid instruction name"},
+		{"nofunc", InstructionDesc{ nil, 0, 0, "", }, "Instruction nofunc has no function"},
+		{"negative", InstructionDesc{ noop, -1, 0, "", }, "negative arity -1"},
+		{"inverted", InstructionDesc{ noop, 3, 2, "", }, "takes at most 2 args but at least 3"},
+	}
+	for _, c := range cases {
+		vm, _ := new_test_vm()
+		err := vm.RegisterInstruction(c.name, c.desc)
+		if c.want_err == "" {
+			if err != nil {
+				t.Errorf("%q: %v", c.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.want_err) {
+			t.Errorf("%q: got %v, expected %q", c.name, err, c.want_err)
+		}
+		var ice_err *IcebergError
+		if !errors.As(err, &ice_err) || ice_err.Kind != ERR_ARGUMENT || !strings.HasPrefix(err.Error(), "Argument ERROR:") {
+			t.Errorf("%q: got %#v, expected an argument error with no position", c.name, err)
+		}
+		_, exist := vm.Inst_table[c.name]
+		if exist {
+			t.Errorf("%q was registered despite the error", c.name)
+		}
+	}
+
+	// The count is checked at compile time, before the function ever runs
+	vm, out := new_test_vm()
+	var got []Entity
+	vm.RegisterInstruction("greet", InstructionDesc{ func(args []Entity) { got = args }, 1, 0, "", })
+	_, err := run_on(vm, out, "greet 1, 2")
+	chk_result(t, err, "Too many arguments(1 expected but 2 given)")
+	_, err = run_on(vm, out, "greet \"hi\"")
+	if err != nil || len(got) != 1 {
+		t.Errorf("got %v args, err %v", got, err)
+	}
+}
+
+func TestBlockComments(t *testing.T) {
+	run_cases(t, []script_case{
+		{"one line", "let x, /* one */ 1", map[string]interface{}{"x": int64(1)}, ""},
+		{"several lines", "let x, 1\n/* let x, 2\nlet x, 3 */\nlet y, x", map[string]interface{}{"y": int64(1)}, ""},
+		{"inside a string", "let s, \"a /* b */ c\"", map[string]interface{}{"s": "a /* b */ c"}, ""},
+		{"commented-out code", "/*\ncat \"a\", \"b\", s\n*/\nlet x, 1", map[string]interface{}{"x": int64(1), "s": unbound}, ""},
+		{"apostrophe in a comment", "/* don't */ let x, 1", map[string]interface{}{"x": int64(1)}, ""},
+		{"lone quote in a comment", "/* a 5\" screen */ let x, 1", map[string]interface{}{"x": int64(1)}, ""},
+		{"lone quote over lines", "/* \"\nlet s, 1\n*/\nlet x, 1", map[string]interface{}{"x": int64(1), "s": unbound}, ""},
+		{"quotes do not hide the end", "/* \"*/ let x, 1", map[string]interface{}{"x": int64(1)}, ""},
+		{"no nesting", "/* a /* b */ let x, 1", map[string]interface{}{"x": int64(1)}, ""},
+		{"line comment marker inside", "/* # */ let x, 1", map[string]interface{}{"x": int64(1)}, ""},
+		{"unterminated", "let x, 1\n/* open", nil, "In line 2,\nSyntax ERROR: Unterminated block comment"},
+	})
+	// Lines after a multi-line comment keep their numbers
+	_, _, err := run_script("/*\n\n*/\nbogus")
+	chk_result(t, err, "In line 4,")
+}
+
+func TestCharat(t *testing.T) {
+	run_cases(t, []script_case{
+		{"ascii", "charat \"abc\", 1, c", map[string]interface{}{"c": "b"}, ""},
+		{"multibyte", "charat \"日本語\", 2, c", map[string]interface{}{"c": "語"}, ""},
+		{"mixed", "charat \"aé😀z\", 2, c\ncharat \"aé😀z\", 3, d", map[string]interface{}{"c": "😀", "d": "z"}, ""},
+		{"multibyte literal intact", "let s, \"ñandú\"\nbytelen s, n", map[string]interface{}{"s": "ñandú", "n": int64(7)}, ""},
+		{"past the end", "charat \"日本\", 2, c", nil, "Argument ERROR: Index 2 out of range for a string of 2 characters"},
+		{"negative", "charat \"abc\", -1, c", nil, "Index -1 out of range"},
+		{"huge", "charat \"abc\", 9223372036854775807, c", nil, "out of range"},
+		{"empty", "charat \"\", 0, c", nil, "out of range for a string of 0 characters"},
+	})
+}
+
+func TestPad(t *testing.T) {
+	run_cases(t, []script_case{
+		{"left", "padleft \"7\", 3, s", map[string]interface{}{"s": "  7"}, ""},
+		{"right", "padright \"ab\", 4, s", map[string]interface{}{"s": "ab  "}, ""},
+		{"custom pad", "padleft \"42\", 5, \"0\", s", map[string]interface{}{"s": "00042"}, ""},
+		{"multibyte pad", "padright \"x\", 3, \"·\", s", map[string]interface{}{"s": "x··"}, ""},
+		{"counts characters", "padleft \"日本\", 4, s", map[string]interface{}{"s": "  日本"}, ""},
+		{"already wide", "padleft \"abcdef\", 3, s\npadright \"ab\", -1, t", map[string]interface{}{"s": "abcdef", "t": "ab"}, ""},
+		{"long pad", "padleft \"a\", 3, \"xy\", s", nil, "Argument ERROR: Pad must be a single character, got \"xy\""},
+		{"empty pad", "padleft \"a\", 3, \"\", s", nil, "Pad must be a single character"},
+		{"huge width", "padleft \"a\", 9223372036854775807, s", nil, "Argument ERROR: Width 9223372036854775807 is too large"},
+		{"too few args", "padleft \"a\", s", nil, "Too few arguments"},
+	})
+}
+
+func TestFmtfloatFmtint(t *testing.T) {
+	run_cases(t, []script_case{
+		{"round", "fmtfloat 3.14159, 2, s", map[string]interface{}{"s": "3.14"}, ""},
+		{"pad zeros", "fmtfloat 2.5, 3, s", map[string]interface{}{"s": "2.500"}, ""},
+		{"no decimals", "fmtfloat 2.5, 0, s\nfmtfloat -0.4, 0, t", map[string]interface{}{"s": "2", "t": "-0"}, ""},
+		{"bad precision", "fmtfloat 1.0, -1, s", nil, "Argument ERROR: Precision must be between 0 and 1000, got -1"},
+		{"int rejected", "fmtfloat 1, 2, s", nil, "expected float but got int"},
+		{"hex", "fmtint 255, 16, s", map[string]interface{}{"s": "ff"}, ""},
+		{"binary negative", "fmtint -5, 2, s", map[string]interface{}{"s": "-101"}, ""},
+		{"base 36", "fmtint 35, 36, s", map[string]interface{}{"s": "z"}, ""},
+		{"bad base", "fmtint 1, 37, s", nil, "Argument ERROR: Base must be between 2 and 36, got 37"},
+		{"base 1", "fmtint 1, 1, s", nil, "Base must be between 2 and 36"},
+	})
+}
+
+func TestHash(t *testing.T) {
+	fnv_a := fnv.New64a()
+	fnv_a.Write([]byte("a"))
+	run_cases(t, []script_case{
+		{"hashstr empty", "hashstr \"\", h", map[string]interface{}{"h": "cbf29ce484222325"}, ""},
+		{"hashstr", "hashstr \"a\", h", map[string]interface{}{"h": "af63dc4c8601ec8c"}, ""},
+		{"hash", "hash \"a\", h", map[string]interface{}{"h": int64(fnv_a.Sum64())}, ""},
+		{"stable", "hash \"iceberg\", a\nhash \"iceberg\", b\ncmp a, \"==\", b, same", map[string]interface{}{"same": true}, ""},
+		{"needs a str", "hash 1, h", nil, "Type mismatch"},
+	})
+}
+
+func TestHex(t *testing.T) {
+	run_cases(t, []script_case{
+		{"encode", "hexencode \"Hi!\", h", map[string]interface{}{"h": "486921"}, ""},
+		{"encode multibyte", "hexencode \"é\", h", map[string]interface{}{"h": "c3a9"}, ""},
+		{"decode", "hexdecode \"486921\", s", map[string]interface{}{"s": "Hi!"}, ""},
+		{"upper case", "hexdecode \"C3A9\", s", map[string]interface{}{"s": "é"}, ""},
+		{"round trip", "hexencode \"a\nb\", h\nhexdecode h, s", map[string]interface{}{"s": "a\nb"}, ""},
+		{"empty", "hexencode \"\", h\nhexdecode \"\", s", map[string]interface{}{"h": "", "s": ""}, ""},
+		{"bad digit", "hexdecode \"zz\", s", nil, "Argument ERROR: hexdecode failed"},
+		{"odd length", "hexdecode \"abc\", s", nil, "hexdecode failed"},
+	})
+}
+
+func TestMatch(t *testing.T) {
+	run_cases(t, []script_case{
+		{"matches", "match \"^\\d+$\", \"12345\", m", map[string]interface{}{"m": true}, ""},
+		{"anywhere", "match \"b+\", \"abbbc\", m", map[string]interface{}{"m": true}, ""},
+		{"no match", "match \"^\\d+$\", \"12a\", m", map[string]interface{}{"m": false}, ""},
+		{"unicode", "match \"^.{3}$\", \"日本語\", m", map[string]interface{}{"m": true}, ""},
+		{"invalid pattern", "match \"(\", \"x\", m", nil, "Argument ERROR: Invalid pattern \"(\""},
+		{"pattern from a variable", "let p, \"x+\"\nmatch p, \"xx\", m", map[string]interface{}{"m": true}, ""},
+	})
+
+	// Patterns are compiled once, and the cache stays bounded
+	vm, out := new_test_vm()
+	_, err := run_on(vm, out, "let i, 0\n@l match \"^a\", \"abc\", m\nadd i, 1, i\ncmp i, \"<\", 10, c\nwhen c, @l")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vm.regex_cache) != 1 {
+		t.Errorf("cache holds %d patterns, expected 1", len(vm.regex_cache))
+	}
+	for i := 0; i < REGEX_CACHE_SIZE * 2; i++ {
+		vm.regex(fmt.Sprintf("p%d", i))
+	}
+	if len(vm.regex_cache) > REGEX_CACHE_SIZE {
+		t.Errorf("cache grew to %d patterns", len(vm.regex_cache))
+	}
+}
+
+func TestCapture(t *testing.T) {
+	date := "\"(\\d{4})-(\\d{2})-(\\d{2})\", \"on 2024-05-17 at noon\""
+	run_cases(t, []script_case{
+		{"group", "capture " + date + ", 2, month", map[string]interface{}{"month": "05"}, ""},
+		{"whole match", "capture " + date + ", 0, all", map[string]interface{}{"all": "2024-05-17"}, ""},
+		{"no match", "capture \"(x)\", \"abc\", 1, g", map[string]interface{}{"g": ""}, ""},
+		{"unused group", "capture \"a(x)?b\", \"ab\", 1, g", map[string]interface{}{"g": ""}, ""},
+		{"group out of range", "capture " + date + ", 4, g", nil, "Argument ERROR: Group 4 out of range, pattern has 3 groups"},
+		{"negative group", "capture \"a\", \"a\", -1, g", nil, "Group -1 out of range"},
+	})
+}
+
+func TestRegexreplace(t *testing.T) {
+	run_cases(t, []script_case{
+		{"every match", "regexreplace \"o\", \"foo boo\", \"0\", s", map[string]interface{}{"s": "f00 b00"}, ""},
+		{"numbered groups", "regexreplace \"(\\w+)@(\\w+)\", \"me@home\", \"$2 at ${1}\", s", map[string]interface{}{"s": "home at me"}, ""},
+		{"named group", "regexreplace \"(?P<n>\\d+)\", \"a1b22\", \"<${n}>\", s", map[string]interface{}{"s": "a<1>b<22>"}, ""},
+		{"no match", "regexreplace \"z\", \"abc\", \"y\", s", map[string]interface{}{"s": "abc"}, ""},
+		{"invalid pattern", "regexreplace \"[\", \"abc\", \"y\", s", nil, "Invalid pattern"},
+	})
+}
+
+func TestParseintbase(t *testing.T) {
+	run_cases(t, []script_case{
+		{"hex", "parseintbase \"ff\", 16, n, ok", map[string]interface{}{"n": int64(255), "ok": true}, ""},
+		{"binary", "parseintbase \"-101\", 2, n, ok", map[string]interface{}{"n": int64(-5), "ok": true}, ""},
+		{"base 36", "parseintbase \"Z\", 36, n, ok", map[string]interface{}{"n": int64(35), "ok": true}, ""},
+		{"prefix", "parseintbase \"0x1f\", 0, a, ok1\nparseintbase \"0b11\", 0, b, ok2\nparseintbase \"0o17\", 0, c, ok3", map[string]interface{}{"a": int64(31), "b": int64(3), "c": int64(15), "ok3": true}, ""},
+		{"bad digit", "parseintbase \"12\", 2, n, ok", map[string]interface{}{"n": int64(0), "ok": false}, ""},
+		{"overflow", "parseintbase \"9223372036854775808\", 10, n, ok", map[string]interface{}{"n": int64(0), "ok": false}, ""},
+		{"empty", "parseintbase \"\", 10, n, ok", map[string]interface{}{"ok": false}, ""},
+		{"bad base", "parseintbase \"1\", 1, n, ok", nil, "Argument ERROR: Base must be 0 or between 2 and 36, got 1"},
+		{"round trip with fmtint", "fmtint -12345, 7, s\nparseintbase s, 7, n, ok", map[string]interface{}{"n": int64(-12345)}, ""},
+	})
+}
+
+func TestBytelen(t *testing.T) {
+	run_cases(t, []script_case{
+		{"ascii", "bytelen \"abc\", n", map[string]interface{}{"n": int64(3)}, ""},
+		{"multibyte", "bytelen \"日本\", n\nbytelen \"é\", m\nbytelen \"😀\", e", map[string]interface{}{"n": int64(6), "m": int64(2), "e": int64(4)}, ""},
+		{"empty", "bytelen \"\", n", map[string]interface{}{"n": int64(0)}, ""},
+		{"needs a str", "bytelen 12, n", nil, "Type mismatch"},
+	})
+}
+
+func TestDeepequal(t *testing.T) {
+	setup := func(vm *IcebergVM) {
+		vm.SetVar("nan", math.NaN())
+	}
+	run_cases_with(t, setup, []script_case{
+		{"same", "deepequal 1, 1, a\ndeepequal \"x\", \"x\", b", map[string]interface{}{"a": true, "b": true}, ""},
+		{"int and float differ", "deepequal 1, 1.0, a", map[string]interface{}{"a": false}, ""},
+		{"different values", "deepequal \"a\", \"b\", a", map[string]interface{}{"a": false}, ""},
+		{"bools", "deepequal true, true, a\ndeepequal true, false, b", map[string]interface{}{"a": true, "b": false}, ""},
+		{"nil", "deepequal nil, nil, a\ndeepequal nil, 0, b", map[string]interface{}{"a": true, "b": false}, ""},
+		{"nan", "deepequal nan, nan, a", map[string]interface{}{"a": false}, ""},
+		{"labels rejected", "deepequal @l, @l, a\n@l", nil, "Type mismatch"},
+	})
+}
+
+func TestExit(t *testing.T) {
+	cases := []struct {
+		script string
+		code int64
+		want_err string
+	}{
+		{"nop", 0, ""},
+		{"exit 3\nlet x, 1", 3, ""},
+		{"exit\nlet x, 1", 0, ""},
+		{"let c, 7\nexit c", 7, ""},
+		{"pushscope\nexit 2", 2, ""},
+		{"try @h, e\nexit 5\n@h", 5, ""},
+		{"exit 1\ndiv 1, 0, x", 1, ""},
+		{"div 1, 0, x\nexit 1", 0, "Math ERROR"},
+		{"exit \"1\"", 0, "Type mismatch"},
+	}
+	for _, c := range cases {
+		vm, _, err := run_script(c.script)
+		if c.want_err == "" && err != nil {
+			t.Errorf("%q: exit is not an error, got %v", c.script, err)
+		}
+		if c.want_err != "" && (err == nil || !strings.Contains(err.Error(), c.want_err)) {
+			t.Errorf("%q: got %v, expected %q", c.script, err, c.want_err)
+		}
+		if vm.ExitCode() != c.code {
+			t.Errorf("%q: exit code %d, expected %d", c.script, vm.ExitCode(), c.code)
+		}
+		chk_vars(t, vm, map[string]interface{}{"x": unbound})
+	}
+
+	// Each run starts from 0
+	vm, out := new_test_vm()
+	run_on(vm, out, "exit 9")
+	run_on(vm, out, "nop")
+	if vm.ExitCode() != 0 {
+		t.Errorf("exit code %d carried over to the next run", vm.ExitCode())
+	}
+}
+
+func TestRegisterInstructions(t *testing.T) {
+	noop := func(args []Entity) {}
+	vm, out := new_test_vm()
+	err := vm.RegisterInstructions(map[string]InstructionDesc{
+		"one": { noop, 1, 0, "", },
+		"two": { noop, 2, 0, "", },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = run_on(vm, out, "one 1\ntwo 1, 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bad_batches := []struct {
+		insts map[string]InstructionDesc
+		want_err string
+	}{
+		{map[string]InstructionDesc{"three": { noop, 0, 0, "", }, "add": { noop, 3, 0, "", }}, "Argument ERROR: add is a built-in instruction"},
+		{map[string]InstructionDesc{"three": { noop, 0, 0, "", }, "bad name": { noop, 0, 0, "", }}, "Invalid instruction name"},
+		{map[string]InstructionDesc{"three": { noop, 0, 0, "", }, "four": { nil, 0, 0, "", }}, "has no function"},
+	}
+	for _, batch := range bad_batches {
+		err = vm.RegisterInstructions(batch.insts)
+		if err == nil || !strings.Contains(err.Error(), batch.want_err) {
+			t.Errorf("got %v, expected %q", err, batch.want_err)
+		}
+		var ice_err *IcebergError
+		if !errors.As(err, &ice_err) || ice_err.Kind != ERR_ARGUMENT {
+			t.Errorf("got %#v, expected an argument *IcebergError", err)
+		}
+		// All or nothing
+		_, exist := vm.Inst_table["three"]
+		if exist {
+			t.Fatal("part of a rejected batch was registered")
+		}
+	}
+	_, err = run_on(vm, out, "add 1, 2, x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chk_vars(t, vm, map[string]interface{}{"x": int64(3)})
+}
+
+func TestHelp(t *testing.T) {
+	vm, _ := new_test_vm()
+	doc, exist := vm.Help("add")
+	if !exist || doc != "add a, b, dest; dest = a + b" {
+		t.Errorf("got %q %v", doc, exist)
+	}
+	// Every built-in is documented, starting with its own name
+	for _, name := range vm.InstructionNames() {
+		doc, _ := vm.Help(name)
+		if !strings.HasPrefix(doc, name) {
+			t.Errorf("%s: doc %q", name, doc)
+		}
+	}
+	vm.RegisterInstruction("quiet", InstructionDesc{ func(args []Entity) {}, 0, 0, "", })
+	doc, exist = vm.Help("quiet")
+	if !exist || doc != "" {
+		t.Errorf("undocumented instruction: got %q %v", doc, exist)
+	}
+	_, exist = vm.Help("bogus")
+	if exist {
+		t.Error("Help found an unknown instruction")
+	}
+}
+
+func TestCommentPrefix(t *testing.T) {
+	run_cases(t, []script_case{
+		{"default #", "let x, 1 # one\n# let x, 2", map[string]interface{}{"x": int64(1)}, ""},
+		{"inside a string", "let s, \"a # b\"", map[string]interface{}{"s": "a # b"}, ""},
+	})
+	slashes := func(vm *IcebergVM) {
+		vm.CommentPrefix = "//"
+	}
+	run_cases_with(t, slashes, []script_case{
+		{"custom", "let x, 1 // one\n// let x, 2", map[string]interface{}{"x": int64(1)}, ""},
+		{"# is plain text", "let s, \"#\"\ncat s, \"x\", s", map[string]interface{}{"s": "#x"}, ""},
+		{"# is not a comment", "let x, 1 # one", nil, "Unbound symbol 1#one"},
+	})
+	disabled := func(vm *IcebergVM) {
+		vm.CommentPrefix = ""
+	}
+	run_cases_with(t, disabled, []script_case{
+		{"disabled", "let x, 1 # one", nil, "Unbound symbol 1#one"},
+		{"block comments still work", "let x, /* one */ 1", map[string]interface{}{"x": int64(1)}, ""},
+	})
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	run_cases(t, []script_case{
+		{"sensitive by default", "ADD 1, 2, x", nil, "Unknown instruction ADD"},
+		{"mixed case by default", "Add 1, 2, x", nil, "Unknown instruction Add"},
+	})
+	insensitive := func(vm *IcebergVM) {
+		vm.CaseInsensitive = true
+		vm.RegisterInstruction("myinst", InstructionDesc{ func(args []Entity) {
+			vm.Assign_var("called", true)
+		}, 0, 0, "", })
+	}
+	run_cases_with(t, insensitive, []script_case{
+		{"built-ins", "LET x, 1\nADD x, 1, x\nAdd x, 1, x", map[string]interface{}{"x": int64(3)}, ""},
+		{"custom", "MYINST", map[string]interface{}{"called": true}, ""},
+		{"labels still sensitive", "GOTO @End\n@end", nil, "Unset label @End"},
+		{"arguments still sensitive", "let X, 1\nlet x, 2", map[string]interface{}{"X": int64(1), "x": int64(2)}, ""},
+		{"unknown", "BOGUS", nil, "Unknown instruction bogus"},
+	})
+}
+
+func TestLabelNames(t *testing.T) {
+	valid := []string{"@a", "@loop_2", "@_x", "@Start", "@ñandú"}
+	for _, label := range valid {
+		_, _, err := run_script("goto " + label + "\n" + label + "\n" + label + "_inline nop")
+		if err != nil {
+			t.Errorf("%s: %v", label, err)
+		}
+	}
+
+	invalid := []struct {
+		script string
+		label string
+	}{
+		{"@\nnop", "@"},
+		{"@123\nnop", "@123"},
+		{"@1abc nop", "@1abc"},
+		{"@a-b\nnop", "@a-b"},
+		{"@a.b nop", "@a.b"},
+		{"@@a\nnop", "@@a"},
+		{"goto @9\n", "@9"},
+		{"labeladdr @x-y, a", "@x-y"},
+		{"try @!, e", "@!"},
+	}
+	for _, c := range invalid {
+		_, _, err := run_script(c.script)
+		var ice_err *IcebergError
+		if !errors.As(err, &ice_err) || !ice_err.Compile_time {
+			t.Errorf("%q: expected a compile error, got %v", c.script, err)
+			continue
+		}
+		want := "Syntax ERROR: Invalid label name " + c.label
+		if ice_err.Message != want {
+			t.Errorf("%q: got %q, expected %q", c.script, ice_err.Message, want)
+		}
+	}
+
+	// A label followed by a space is a label prefixing an instruction
+	_, _, err := run_script("@a b")
+	chk_result(t, err, "Unknown instruction b")
+}
+
+func TestJmprel(t *testing.T) {
+	run_cases(t, []script_case{
+		{"skip forward", "jmprel 2\nlet skipped, true\nlet x, 1", map[string]interface{}{"skipped": unbound, "x": int64(1)}, ""},
+		{"next", "jmprel 1\nlet x, 1", map[string]interface{}{"x": int64(1)}, ""},
+		{"backward loop", "let i, 0\nadd i, 1, i\ncmp i, \"<\", 3, c\nwhen c, @back\ngoto @end\n@back jmprel -5\n@end", map[string]interface{}{"i": int64(3)}, ""},
+		{"labels count", "jmprel 2\n@l\nlet x, 1", map[string]interface{}{"x": int64(1)}, ""},
+		{"from a variable", "let o, 2\njmprel o\nlet skipped, true\nlet x, 1", map[string]interface{}{"skipped": unbound}, ""},
+		{"before the start", "nop\njmprel -2", nil, "Argument ERROR: Relative jump -2 from instruction 1 out of range"},
+		{"past the end", "jmprel 2\nnop", nil, "Relative jump 2 from instruction 0 out of range"},
+		{"huge", "jmprel 9223372036854775807", nil, "out of range"},
+	})
+}
+
+func TestHere(t *testing.T) {
+	run_cases(t, []script_case{
+		{"first", "here h", map[string]interface{}{"h": int64(0)}, ""},
+		{"labels count", "nop\n@l\nhere h", map[string]interface{}{"h": int64(2)}, ""},
+		{"loop with gotoidx", "let i, 0\nhere h\nadd i, 1, i\ncmp i, \"<\", 3, c\nwhen c, @back\ngoto @end\n@back gotoidx h\n@end", map[string]interface{}{"i": int64(3), "h": int64(1)}, ""},
+		{"type mismatch", "let h, \"s\"\nhere h", nil, "Type ERROR"},
+	})
+}
+
+func TestReprfloat(t *testing.T) {
+	run_cases(t, []script_case{
+		{"whole", "reprfloat 2.0, s", map[string]interface{}{"s": "2.0"}, ""},
+		{"fraction", "reprfloat 0.1, s", map[string]interface{}{"s": "0.1"}, ""},
+		{"shortest round trip", "add 0.1, 0.2, f\nreprfloat f, s", map[string]interface{}{"s": "0.30000000000000004"}, ""},
+		{"large", "reprfloat 1e20, s", map[string]interface{}{"s": "1e+20"}, ""},
+		{"small", "reprfloat 0.00001, s", map[string]interface{}{"s": "1e-05"}, ""},
+		{"negative", "reprfloat -1.5, s", map[string]interface{}{"s": "-1.5"}, ""},
+		{"int", "reprfloat 1, s", nil, "Type ERROR"},
+	})
+}
+
+func TestStrWholeFloat(t *testing.T) {
+	run_cases(t, []script_case{
+		{"whole", "str s, 2.0", map[string]interface{}{"s": "2.0"}, ""},
+		{"negative whole", "str s, -3.0", map[string]interface{}{"s": "-3.0"}, ""},
+		{"converted from int", "float f, 4\nstr s, f", map[string]interface{}{"s": "4.0"}, ""},
+		{"fraction", "str s, 2.5", map[string]interface{}{"s": "2.5"}, ""},
+		{"int", "str s, 2", map[string]interface{}{"s": "2"}, ""},
+	})
+}
+
+func TestBoolstr(t *testing.T) {
+	run_cases(t, []script_case{
+		{"true", "boolstr true, s", map[string]interface{}{"s": "1"}, ""},
+		{"false", "boolstr false, s", map[string]interface{}{"s": "0"}, ""},
+		{"from cmp", "cmp 1, \"<\", 2, c\nboolstr c, s", map[string]interface{}{"s": "1"}, ""},
+		{"int", "boolstr 1, s", nil, "Type ERROR"},
+	})
+}
+
+func TestIntCast(t *testing.T) {
+	run_cases(t, []script_case{
+		{"truncates", "int x, 2.9", map[string]interface{}{"x": int64(2)}, ""},
+		{"truncates negative", "int x, -2.9", map[string]interface{}{"x": int64(-2)}, ""},
+		{"smallest", "int x, -9223372036854775808.0", map[string]interface{}{"x": int64(math.MinInt64)}, ""},
+		{"nan", "mul 1e308, 10.0, big\nsub big, big, n\nint x, n", nil, "Math ERROR: Cannot convert NaN to int"},
+		{"too large", "int x, 1e19", nil, "Math ERROR: 1e+19 is out of the int range"},
+		{"two to the 63", "int x, 9223372036854775808.0", nil, "out of the int range"},
+		{"too small", "int x, -1e19", nil, "Math ERROR: -1e+19 is out of the int range"},
+		{"infinite", "mul 1e308, 10.0, big\nint x, big", nil, "Math ERROR: +Inf is out of the int range"},
+	})
+}
+
+func TestCmpMixed(t *testing.T) {
+	run_cases(t, []script_case{
+		{"int less than float", "cmp 1, \"<\", 1.5, c", map[string]interface{}{"c": true}, ""},
+		{"float greater than int", "cmp 2.5, \">\", 2, c", map[string]interface{}{"c": true}, ""},
+		{"equal across types", "cmp 2, \"==\", 2.0, c", map[string]interface{}{"c": true}, ""},
+		{"not equal across types", "cmp 2, \"!=\", 2.0, c", map[string]interface{}{"c": false}, ""},
+		{"large ints compare exactly", "cmp 9007199254740993, \">\", 9007199254740992, c", map[string]interface{}{"c": true}, ""},
+		{"nan", "mul 1e308, 10.0, big\nsub big, big, n\ncmp 1, \"==\", n, e\ncmp 1, \"!=\", n, ne\ncmp n, \"<\", 1, l", map[string]interface{}{"e": false, "ne": true, "l": false}, ""},
+		{"string against number", "cmp \"a\", \"==\", 1, c", nil, "Type ERROR"},
+		{"number against string", "cmp 1, \"==\", \"a\", c", nil, "Type ERROR"},
+	})
+}
+
+func TestMixedArithmetic(t *testing.T) {
+	run_cases(t, []script_case{
+		{"add", "add 1, 0.5, x", map[string]interface{}{"x": 1.5}, ""},
+		{"sub", "sub 2.5, 1, x", map[string]interface{}{"x": 1.5}, ""},
+		{"mul", "mul 2, 1.5, x", map[string]interface{}{"x": 3.0}, ""},
+		{"whole result stays float", "add 1, 1.0, x", map[string]interface{}{"x": 2.0}, ""},
+		{"int mod", "mod 7, 3, x", map[string]interface{}{"x": int64(1)}, ""},
+		{"mod by a float", "mod 5, 0.5, x", map[string]interface{}{"x": 0.0}, ""},
+		{"float mod", "mod 5.5, 2, x", map[string]interface{}{"x": 1.5}, ""},
+		{"negative float mod", "mod -5.5, 2, x", map[string]interface{}{"x": -1.5}, ""},
+		{"float mod by zero", "mod 5.5, 0, x", nil, "Math ERROR: Division by zero"},
+		{"int destination", "let x, 0\nadd 1, 0.5, x", nil, "Type ERROR"},
+	})
+}
+
+func TestNil(t *testing.T) {
+	run_cases(t, []script_case{
+		{"literal", "let x, nil\nisnil x, n", map[string]interface{}{"x": nil, "n": true}, ""},
+		{"not nil", "let x, 0\nisnil x, n", map[string]interface{}{"n": false}, ""},
+		{"empty string is not nil", "isnil \"\", n", map[string]interface{}{"n": false}, ""},
+		{"replaced by an int", "let x, nil\nlet x, 1", map[string]interface{}{"x": int64(1)}, ""},
+		{"replaced by a str", "let x, nil\nlet x, \"s\"", map[string]interface{}{"x": "s"}, ""},
+		{"replaces an int", "let x, 1\nlet x, nil", map[string]interface{}{"x": nil}, ""},
+		{"replaces a float", "let x, 1.5\nlet x, nil", map[string]interface{}{"x": nil}, ""},
+		{"replaces a bool", "let x, true\nlet x, nil", map[string]interface{}{"x": nil}, ""},
+		{"type fixed again", "let x, nil\nlet x, 1\nlet x, \"s\"", nil, "Type ERROR: Type mismatch, x holds int but got str"},
+		{"nil keeps the type", "let x, 1\nlet x, nil\nlet x, \"s\"", nil, "Type ERROR: Type mismatch, x holds int but got str"},
+		{"nil keeps the type over nils", "let x, 1.5\nlet x, nil\nlet x, nil\nlet x, true", nil, "x holds float but got bool"},
+		{"same type after nil", "let x, 1\nlet x, nil\nisnil x, n\nlet x, 2", map[string]interface{}{"x": int64(2), "n": true}, ""},
+		{"untyped nil takes any type", "let x, nil\nlet x, nil\nlet x, \"s\"", map[string]interface{}{"x": "s"}, ""},
+		{"copy of a nil is untyped", "let x, 1\nlet x, nil\nlet y, x\nlet y, \"s\"", map[string]interface{}{"x": nil, "y": "s"}, ""},
+		{"typed nil equals nil", "let x, 1\nlet x, nil\ndeepequal x, nil, e", map[string]interface{}{"e": true}, ""},
+		{"pop into a typed nil", "let x, 1\nlet x, nil\npush \"s\"\npop x", nil, "x holds int but got str"},
+		{"str of nil", "str s, nil", map[string]interface{}{"s": "nil"}, ""},
+		{"bool of nil", "bool b, nil", map[string]interface{}{"b": false}, ""},
+		{"arithmetic", "add nil, 1, x", nil, "Type ERROR"},
+		{"label", "@l\nisnil @l, n", nil, "Type ERROR"},
+	})
+	// Host calls see the same rule
+	vm, _ := new_test_vm()
+	vm.SetVar("x", 1)
+	err := vm.SetVar("x", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chk_result(t, vm.SetVar("x", "s"), "Type ERROR: Type mismatch, x holds int but got str")
+	chk_result(t, vm.SetInputs(map[string]interface{}{"x": "s"}), "x holds int but got str")
+	chk_result(t, vm.Clone().SetVar("x", "s"), "x holds int but got str")
+	chk_vars(t, vm, map[string]interface{}{"x": nil})
+
+	if TypeName(T_NIL) != "nil" {
+		t.Errorf("TypeName(T_NIL) is %q", TypeName(T_NIL))
+	}
+}
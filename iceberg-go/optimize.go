@@ -0,0 +1,256 @@
+// Icestorm - bytecode optimization passes and static analysis
+
+package iceberg
+
+import(
+	"reflect"
+)
+
+// Positions of the value operands and the destination of each foldable instruction
+type fold_desc struct {
+	operands []int
+	dest int
+}
+
+var foldable_insts = map[string]fold_desc{
+	"add": { []int{0, 1}, 2 },
+	"sub": { []int{0, 1}, 2 },
+	"mul": { []int{0, 1}, 2 },
+	"div": { []int{0, 1}, 2 },
+	"div_r": { []int{0, 1}, 2 },
+	"mod": { []int{0, 1}, 2 },
+	"pow": { []int{0, 1}, 2 },
+	"cmp": { []int{0, 1, 2}, 3 },
+	"and": { []int{0, 1}, 2 },
+	"or": { []int{0, 1}, 2 },
+	"xor": { []int{0, 1}, 2 },
+	"not": { []int{0}, 1 },
+	"cat": { []int{0, 1}, 2 },
+}
+
+// Instructions that touch no variables other than their arguments and never jump
+var straight_insts = map[string]bool{
+	"nop": true, "note": true, "let": true,
+	"add": true, "sub": true, "mul": true, "div": true, "div_r": true, "mod": true, "pow": true,
+	"hypot": true, "powmod": true, "gcd": true, "lcm": true, "sign": true, "isnan": true, "isinf": true,
+	"cmp": true, "and": true, "or": true, "xor": true, "not": true,
+	"int": true, "float": true, "bool": true, "str": true, "cat": true, "select": true, "charat": true, "bytelen": true, "deepequal": true, "isnil": true,
+	"padleft": true, "padright": true, "fmtfloat": true, "fmtint": true, "reprfloat": true, "boolstr": true,
+	"hash": true, "hashstr": true, "parseintbase": true, "hexencode": true, "hexdecode": true,
+	"match": true, "capture": true, "regexreplace": true,
+}
+
+var cast_types = map[string]int64{
+	"int": T_INT,
+	"float": T_FLOAT,
+	"bool": T_BOOL,
+	"str": T_STR,
+}
+
+// Whether two descriptors run the same built-in, even if bound to different VMs
+func same_inst(a InstructionDesc, b InstructionDesc) bool {
+	return reflect.ValueOf(a.Function).Pointer() == reflect.ValueOf(b.Function).Pointer()
+}
+
+// Returns a copy of code with the passes below applied
+func (vm *IcebergVM) Optimize(code Bytecode) Bytecode {
+	inst_list := make([]instruction, len(code.inst_list))
+	copy(inst_list, code.inst_list)
+	label_table := make(map[string]int64)
+	for key, value := range code.label_table {
+		label_table[key] = value
+	}
+
+	builtins := &IcebergVM{}
+	builtins.Init()
+	builtins.StrictFloat = vm.StrictFloat
+	builtins.MaxStringLen = vm.MaxStringLen
+
+	vm.fold_constants(inst_list, builtins)
+	vm.remove_redundant_casts(inst_list, label_table, builtins)
+	vm.eliminate_dead_stores(inst_list, label_table, builtins)
+	return Bytecode{
+		inst_list,
+		label_table,
+	}
+}
+
+// Replaces an instruction whose operands are all literals with a let of its result.
+// Instructions that would fail at runtime are left alone so they still fail there.
+func (vm *IcebergVM) fold_constants(inst_list []instruction, scratch *IcebergVM) {
+	if !same_inst(vm.Inst_table["let"], scratch.Inst_table["let"]) {
+		return
+	}
+
+	for i, instr := range inst_list {
+		desc, ok := foldable_insts[instr.Inst]
+		if !ok || !same_inst(vm.Inst_table[instr.Inst], scratch.Inst_table[instr.Inst]) {
+			continue
+		}
+		if instr.Args[desc.dest].E_type != T_UNDET {
+			continue
+		}
+		all_literal := true
+		for _, idx := range desc.operands {
+			if instr.Args[idx].E_type == T_UNDET {
+				all_literal = false
+			}
+		}
+		if !all_literal {
+			continue
+		}
+
+		scratch.var_table = make(map[string]Entity)
+		err := scratch.catch_error(func() {
+			scratch.Inst_table[instr.Inst].Function(instr.Args)
+		})
+		if err != nil {
+			continue
+		}
+		result, exist := scratch.var_table[string(instr.Args[desc.dest].Data)]
+		if !exist {
+			continue
+		}
+		inst_list[i] = instruction{
+			"let",
+			[]Entity{ instr.Args[desc.dest], result },
+		}
+	}
+}
+
+// Rewrites a cast whose source already has the target type into a let, or a nop
+// when it casts a symbol onto itself. Types are known from literals and from
+// lets and casts earlier in the same straight-line run of instructions. Code using
+// gotoidx or jmprel is left alone, as those can land on any instruction.
+func (vm *IcebergVM) remove_redundant_casts(inst_list []instruction, label_table map[string]int64, builtins *IcebergVM) {
+	for _, instr := range inst_list {
+		if instr.Inst == "gotoidx" || instr.Inst == "jmprel" {
+			return
+		}
+	}
+	is_target := make(map[int]bool)
+	for _, prog_idx := range label_table {
+		is_target[int(prog_idx)] = true
+	}
+
+	known_types := make(map[string]int64)
+	for i, instr := range inst_list {
+		if is_target[i] || !straight_insts[instr.Inst] || !same_inst(vm.Inst_table[instr.Inst], builtins.Inst_table[instr.Inst]) {
+			known_types = make(map[string]int64)
+			continue
+		}
+
+		cast_type, is_cast := cast_types[instr.Inst]
+		if is_cast && instr.Args[0].E_type == T_UNDET {
+			dest := instr.Args[0]
+			source := instr.Args[1]
+			source_type := source.E_type
+			if source_type == T_UNDET {
+				source_type = known_types[string(source.Data)]
+			}
+			if source_type == cast_type {
+				if source.E_type == T_UNDET && string(source.Data) == string(dest.Data) {
+					inst_list[i] = instruction{
+						"nop",
+						[]Entity{},
+					}
+				} else {
+					inst_list[i] = instruction{
+						"let",
+						[]Entity{ dest, source },
+					}
+				}
+			}
+			known_types[string(dest.Data)] = cast_type
+			continue
+		}
+
+		// Anything else may change the type of the symbols it is given
+		for _, arg := range instr.Args {
+			if arg.E_type == T_UNDET {
+				delete(known_types, string(arg.Data))
+			}
+		}
+		if instr.Inst == "let" && instr.Args[0].E_type == T_UNDET && instr.Args[1].E_type != T_UNDET {
+			known_types[string(instr.Args[0].Data)] = instr.Args[1].E_type
+		}
+	}
+}
+
+// Turns a let of a literal into nop when the same symbol is given another literal
+// of the same type before anything could read it. Only nop and note may sit in
+// between: any other instruction could raise an error, and the state left after
+// a failed run must still show the first store. The scan also gives up at labels.
+// Stores become nop rather than being removed so instruction indices stay valid.
+func (vm *IcebergVM) eliminate_dead_stores(inst_list []instruction, label_table map[string]int64, builtins *IcebergVM) {
+	// With these limits even the overwriting let can fail
+	if vm.MaxMemoryBytes > 0 || vm.MaxStringLen > 0 {
+		return
+	}
+	is_target := make(map[int]bool)
+	for _, prog_idx := range label_table {
+		is_target[int(prog_idx)] = true
+	}
+	is_builtin := func(instr instruction) bool {
+		return same_inst(vm.Inst_table[instr.Inst], builtins.Inst_table[instr.Inst])
+	}
+	cannot_fail := func(instr instruction) bool {
+		if !is_builtin(instr) {
+			return false
+		}
+		return instr.Inst == "nop" || (instr.Inst == "note" && instr.Args[0].E_type == T_STR)
+	}
+
+	for i, store := range inst_list {
+		if store.Inst != "let" || !is_builtin(store) {
+			continue
+		}
+		if store.Args[0].E_type != T_UNDET || store.Args[1].E_type == T_UNDET {
+			continue
+		}
+		symbol := string(store.Args[0].Data)
+
+		for j := i + 1; j < len(inst_list); j++ {
+			next := inst_list[j]
+			if is_target[j] {
+				break
+			}
+			if next.Inst == "let" && is_builtin(next) && next.Args[0].E_type == T_UNDET && string(next.Args[0].Data) == symbol &&
+				next.Args[1].E_type == store.Args[1].E_type {
+				inst_list[i] = instruction{
+					"nop",
+					[]Entity{},
+				}
+				break
+			}
+			if !cannot_fail(next) {
+				break
+			}
+		}
+	}
+}
+
+// Relative cost of one execution of an instruction; anything not listed costs 1
+var inst_costs = map[string]int64{
+	"nop": 0, "note": 0,
+	"div": 2, "div_r": 2, "mod": 2, "gcd": 2, "lcm": 2,
+	"pow": 4, "hypot": 3, "powmod": 8,
+	"str": 2, "cat": 2,
+	"match": 10, "capture": 10, "regexreplace": 10,
+	"getenv": 10, "dump": 20, "readfile": 50, "writefile": 50,
+}
+
+// Heuristic static cost of code, summed per instruction name. Every instruction is
+// counted once as if the program ran straight through: loops cannot be bounded
+// statically, so a jump back costs nothing extra. Sum the values for a program total.
+func (vm *IcebergVM) CostEstimate(code Bytecode) map[string]int64 {
+	costs := make(map[string]int64)
+	for _, instr := range code.inst_list {
+		cost, ok := inst_costs[instr.Inst]
+		if !ok {
+			cost = 1
+		}
+		costs[instr.Inst] += cost
+	}
+	return costs
+}
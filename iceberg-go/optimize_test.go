@@ -0,0 +1,157 @@
+package iceberg
+
+import (
+	"strings"
+	"testing"
+)
+
+// Names of the instructions in code, separated by spaces
+func inst_names(code Bytecode) string {
+	names := make([]string, len(code.inst_list))
+	for i, instr := range code.inst_list {
+		names[i] = instr.Inst
+	}
+	return strings.Join(names, " ")
+}
+
+type optimize_case struct {
+	name string
+	script string
+	// Instruction names after Optimize
+	want_insts string
+}
+
+// Checks the shape of the optimized code, and that it leaves the same variables,
+// output and error as the original
+func run_optimize_cases(t *testing.T, setup func(vm *IcebergVM), cases []optimize_case) {
+	t.Helper()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			plain, plain_out := new_test_vm()
+			opt, opt_out := new_test_vm()
+			if setup != nil {
+				setup(plain)
+				setup(opt)
+			}
+			code, err := opt.Compile(c.script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			optimized := opt.Optimize(code)
+			if inst_names(optimized) != c.want_insts {
+				t.Errorf("got %q, expected %q", inst_names(optimized), c.want_insts)
+			}
+
+			_, plain_err := run_on(plain, plain_out, c.script)
+			opt_err := opt.Run(optimized)
+			if (plain_err == nil) != (opt_err == nil) {
+				t.Fatalf("plain run: %v, optimized run: %v", plain_err, opt_err)
+			}
+			if plain_err != nil {
+				plain_msg := plain_err.(*IcebergError).Message
+				opt_msg := opt_err.(*IcebergError).Message
+				if plain_msg != opt_msg {
+					t.Errorf("plain run: %s, optimized run: %s", plain_msg, opt_msg)
+				}
+			}
+			plain_vars := plain.Vars()
+			opt_vars := opt.Vars()
+			if len(plain_vars) != len(opt_vars) {
+				t.Fatalf("plain run left %v, optimized run left %v", plain_vars, opt_vars)
+			}
+			for key, value := range plain_vars {
+				if opt_vars[key] != value {
+					t.Errorf("%s: plain run left %#v, optimized run left %#v", key, value, opt_vars[key])
+				}
+			}
+			// Dropping a redundant cast also drops its warning
+			if !strings.Contains(plain_out.String(), "WARNING:") && plain_out.String() != opt_out.String() {
+				t.Errorf("plain run printed %q, optimized run printed %q", plain_out.String(), opt_out.String())
+			}
+		})
+	}
+}
+
+func TestFoldConstants(t *testing.T) {
+	run_optimize_cases(t, nil, []optimize_case{
+		{"arithmetic", "add 2, 3, x\nmul 1.5, 2, y", "let let"},
+		{"cmp and cat", "cmp 1, \"<\", 2, c\ncat \"a\", \"b\", s\nnot true, n", "let let let"},
+		{"symbol operand", "let a, 1\nadd a, 2, x", "let add"},
+		{"division by zero stays", "div 1, 0, x", "div"},
+		{"type mismatch stays", "let x, \"s\"\nadd 1, 2, x", "let let"},
+		{"inside a loop", "let i, 0\n@l add i, 1, i\nadd 2, 2, four\ncmp i, \"<\", 3, c\nwhen c, @l", "let nop add let cmp when"},
+	})
+	strict := func(vm *IcebergVM) {
+		vm.StrictFloat = true
+	}
+	run_optimize_cases(t, strict, []optimize_case{
+		{"infinite stays under StrictFloat", "mul 1e300, 1e300, x", "mul"},
+	})
+
+	// A replaced built-in is not folded
+	vm, _ := new_test_vm()
+	vm.RegisterInstruction("add", InstructionDesc{ func(args []Entity) {}, 3, 0, "", })
+	code := vm.Optimize(vm.Gen_bytecode("add 1, 2, x"))
+	if inst_names(code) != "add" {
+		t.Errorf("folded a custom add: %q", inst_names(code))
+	}
+}
+
+func TestEliminateDeadStores(t *testing.T) {
+	run_optimize_cases(t, nil, []optimize_case{
+		{"overwritten", "let z, 1\nlet z, 2", "nop let"},
+		{"nop and note between", "let z, 1\nnop\nnote \"x\"\nlet z, 2", "nop nop note let"},
+		{"read between", "let z, 1\nadd z, 1, y\nlet z, 2", "let add let"},
+		{"other type", "let z, 1\nlet z, nil", "let let"},
+		{"label between", "let z, 1\n@l\nlet z, 2", "let nop let"},
+		{"symbol source", "let a, 1\nlet z, a\nlet z, 2", "let let let"},
+		// The first store must survive the error in between
+		{"failing hexdecode between", "let z, 1\nhexdecode \"zz\", q\nlet z, 2", "let hexdecode let"},
+		{"failing div between", "let z, 1\ndiv 1, 0, q\nlet z, 2", "let div let"},
+		{"failing int between", "let z, 1\nint q, \"x\"\nlet z, 2", "let int let"},
+		{"failing match between", "let z, 1\nmatch \"(\", \"s\", q\nlet z, 2", "let match let"},
+		{"non-literal note", "let z, 1\nnote z\nlet z, 2", "let note let"},
+	})
+	limited := func(vm *IcebergVM) {
+		vm.MaxMemoryBytes = 20
+	}
+	run_optimize_cases(t, limited, []optimize_case{
+		{"memory limit", "let z, \"0123456789\"\nlet z, \"01234567890123456789\"", "let let"},
+	})
+}
+
+func TestRemoveRedundantCasts(t *testing.T) {
+	run_optimize_cases(t, nil, []optimize_case{
+		{"literal of the target type", "int x, 5\nstr s, \"a\"", "let let"},
+		{"cast onto itself", "let x, 5\nint x, x", "let nop"},
+		{"known from a cast", "float f, 1\nfloat g, f", "float let"},
+		{"real conversion stays", "let x, 5\nstr s, x", "let str"},
+		{"unknown after a jump target", "let x, 5\n@l\nint x, x", "let nop int"},
+		{"unknown after another write", "let x, 5\npop x\nint x, x", "let pop int"},
+		{"float to int stays", "int x, 2.5", "int"},
+		// The second visit to int y, x, through a computed jump, sees a float x
+		{"gotoidx", "let x, 5\nint y, x\ncmp y, \"==\", 2, done\nwhen done, @end\nlet x, nil\nlet x, 2.5\ngotoidx 1\n@end", "let int cmp when let let gotoidx nop"},
+		{"jmprel", "let x, 5\nint y, x\ncmp y, \"==\", 2, done\nwhen done, @end\nlet x, nil\nlet x, 2.5\njmprel -5\n@end", "let int cmp when let let jmprel nop"},
+	})
+
+	vm, out := new_test_vm()
+	err := vm.Run(vm.Optimize(vm.Gen_bytecode("let x, 5\nint x, x")))
+	if err != nil || out.Len() != 0 {
+		t.Errorf("optimized run printed %q, err %v", out.String(), err)
+	}
+}
+
+func TestCostEstimate(t *testing.T) {
+	vm, _ := new_test_vm()
+	code := vm.Gen_bytecode("@l let x, 1\nadd x, 1, x\nadd x, 2, x\ndiv x, 2, x\nnote \"free\"\nmatch \"a\", \"b\", m\nwhen m, @l")
+	want := map[string]int64{"nop": 0, "let": 1, "add": 2, "div": 2, "note": 0, "match": 10, "when": 1}
+	costs := vm.CostEstimate(code)
+	if len(costs) != len(want) {
+		t.Fatalf("got %v, expected %v", costs, want)
+	}
+	for inst, cost := range want {
+		if costs[inst] != cost {
+			t.Errorf("%s: got %d, expected %d", inst, costs[inst], cost)
+		}
+	}
+}
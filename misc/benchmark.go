@@ -18,7 +18,7 @@ func (vm *testVM) inst_print(args []iceberg.Entity) {
 
 func (vm *testVM) start() {
     vm.Init()
-    vm.Inst_table["print"] = iceberg.InstructionDesc{ vm.inst_print, 1, }
+    vm.Inst_table["print"] = iceberg.InstructionDesc{ vm.inst_print, 1, 0, "print str; prints str and a newline", }
 }
 
 func main() {
@@ -33,9 +33,17 @@ func main() {
 
 	t0 := time.Now()
 	
-	bytecode := vm.Gen_bytecode(script)
+	bytecode, err := vm.Compile(script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
-	vm.Run(bytecode)
+	err = vm.Run(bytecode)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
 	t1 := time.Now()
 	fmt.Printf("Execution time(indluding compilation): %v ms\n", int64(t1.Sub(t0) / time.Millisecond))
@@ -0,0 +1,47 @@
+//go:build js && wasm
+
+// Runs an Iceberg script in the browser. Output goes to the console and the
+// script sees no real environment or filesystem. Build it from this directory with
+//   GO111MODULE=off GOOS=js GOARCH=wasm go build -o iceberg.wasm
+package main
+
+import(
+	"bytes"
+	"errors"
+	"io"
+	"syscall/js"
+	"../../iceberg-go"
+)
+
+type no_fs struct{}
+
+func (no_fs) Open(name string) (io.ReadCloser, error) {
+	return nil, errors.New("no filesystem")
+}
+func (no_fs) Create(name string) (io.WriteCloser, error) {
+	return nil, errors.New("no filesystem")
+}
+
+// runIceberg(source) returns the script output, or the error message
+func run_iceberg(this js.Value, args []js.Value) interface{} {
+	var out bytes.Buffer
+	vm := &iceberg.IcebergVM{}
+	vm.Init()
+	vm.Stdout = &out
+	vm.FS = no_fs{}
+	vm.Environ = func(string) (string, bool) { return "", false }
+
+	code, err := vm.Compile(args[0].String())
+	if err == nil {
+		err = vm.Run(code)
+	}
+	if err != nil {
+		out.WriteString(err.Error())
+	}
+	return out.String()
+}
+
+func main() {
+	js.Global().Set("runIceberg", js.FuncOf(run_iceberg))
+	select {}
+}